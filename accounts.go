@@ -0,0 +1,233 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"fmt"
+	"math/rand"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+type Account struct {
+	name     string
+	password []byte   //bcrypt hashed password, nil if password login is disabled
+	certfps  []string //SHA-256 fingerprints of client certificates that may log in
+}
+
+//Load the accounts file. Each line holds an account name, its bcrypt hashed
+//password (or * for none) and optionally any number of client certificate
+//fingerprints, separated by spaces. Anything after a # is a comment. A
+//missing file is treated as empty, as it is created when the first account is
+//registered.
+func loadAccounts(path string) (map[string]*Account, error) {
+	accounts := make(map[string]*Account)
+
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return accounts, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := scanner.Text()
+		if i := strings.IndexRune(line, '#'); i > -1 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+
+		if len(fields) < 2 {
+			return nil, fmt.Errorf("%s:%d: expected an account name and password", path, lineNum)
+		}
+
+		account := &Account{name: fields[0]}
+		if fields[1] != "*" {
+			account.password = []byte(fields[1])
+		}
+		for _, fp := range fields[2:] {
+			account.certfps = append(account.certfps, normalizeFingerprint(fp))
+		}
+
+		key := strings.ToLower(account.name)
+		if _, exists := accounts[key]; exists {
+			return nil, fmt.Errorf("%s:%d: duplicate account %q", path, lineNum, account.name)
+		}
+		accounts[key] = account
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return accounts, nil
+}
+
+//Write the accounts out to the accounts file, replacing it atomically so a
+//crash can't leave it half written
+func saveAccounts(path string, accounts map[string]*Account) error {
+	names := make([]string, 0, len(accounts))
+	for name := range accounts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	tmpPath := path + ".tmp"
+	f, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+
+	w := bufio.NewWriter(f)
+	fmt.Fprintln(w, "#Rosella accounts. This file is rewritten when accounts are registered.")
+	for _, name := range names {
+		account := accounts[name]
+		password := "*"
+		if account.password != nil {
+			password = string(account.password)
+		}
+		fields := append([]string{account.name, password}, account.certfps...)
+		fmt.Fprintln(w, strings.Join(fields, " "))
+	}
+
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmpPath, path)
+}
+
+//The account that owns a nick, if any. Every account owns the nick matching
+//its name.
+func (s *Server) nickOwner(nick string) *Account {
+	return s.accountMap[strings.ToLower(nick)]
+}
+
+//Log the user in to an account, or out of their account if name is empty, and
+//tell everyone who has asked to know about it
+func (c *Client) setAccount(name string) {
+	c.account = name
+
+	accountName := name
+	if accountName == "" {
+		accountName = "*"
+	}
+
+	if c.registered && c.capMap["account-notify"] {
+		c.reply(rplAccount, c.nick, accountName)
+	}
+	visited := make(map[*Client]struct{}, 100)
+	visited[c] = struct{}{}
+	for _, channel := range c.channelMap {
+		for _, client := range channel.clientMap {
+			if _, skip := visited[client]; skip {
+				continue
+			}
+			if client.capMap["account-notify"] {
+				client.reply(rplAccount, c.nick, accountName)
+			}
+			visited[client] = struct{}{}
+		}
+	}
+
+	if name != "" {
+		c.reply(rplLoggedIn, name)
+		for _, channel := range c.channelMap {
+			channel.applyAccess(c)
+		}
+		if c.nickTimer != nil && strings.ToLower(name) == c.key {
+			//They've proven they own their nick
+			c.nickTimer.Stop()
+			c.nickTimer = nil
+		}
+	}
+}
+
+//Check whether the user may keep their nick, and if it belongs to an account
+//they're not logged in to, give them a limited time to identify
+func (c *Client) checkNickOwnership() {
+	if c.nickTimer != nil {
+		c.nickTimer.Stop()
+		c.nickTimer = nil
+	}
+
+	owner := c.server.nickOwner(c.nick)
+	if owner == nil || strings.ToLower(owner.name) == strings.ToLower(c.account) {
+		return
+	}
+
+	timeout := c.server.config.Load().Limits.IdentifyTimeout
+	c.reply(rplNotice, nickServ, c.target(), fmt.Sprintf("This nickname is registered. Please identify with /msg %s IDENTIFY <password> within %d seconds, or your nickname will be changed.", nickServ, int(timeout.Seconds())))
+
+	nick := c.nick
+	server := c.server
+	c.nickTimer = time.AfterFunc(timeout, func() {
+		server.eventChan <- Event{client: c, event: nickTimeout, input: nick}
+	})
+}
+
+//Change the user's nick to an unused guest nick, after they failed to
+//identify for the nick they were using
+func (c *Client) enforceNick() {
+	c.nickTimer = nil
+
+	guestNick := ""
+	for {
+		guestNick = fmt.Sprintf("Guest%05d", rand.Intn(100000))
+		if _, exists := c.server.clientMap[strings.ToLower(guestNick)]; !exists {
+			break
+		}
+	}
+
+	c.reply(rplNotice, nickServ, c.target(), "You failed to identify in time, your nickname has been changed to "+guestNick)
+	c.setNick(guestNick)
+}
+
+//Check whether a client certificate fingerprint may log in to the account
+func (a *Account) hasCertFP(fp string) bool {
+	if fp == "" {
+		return false
+	}
+	for _, accountFP := range a.certfps {
+		if accountFP == fp {
+			return true
+		}
+	}
+	return false
+}
+
+//Fingerprints are compared as lowercase hex without separators
+func normalizeFingerprint(fp string) string {
+	return strings.ToLower(strings.Replace(fp, ":", "", -1))
+}
+
+//The SHA-256 fingerprint of the client certificate presented on a connection,
+//or an empty string if there isn't one
+func certFingerprint(conn net.Conn) string {
+	tlsConn, ok := conn.(*tls.Conn)
+	if !ok {
+		return ""
+	}
+
+	state := tlsConn.ConnectionState()
+	if len(state.PeerCertificates) == 0 {
+		return ""
+	}
+
+	sum := sha256.Sum256(state.PeerCertificates[0].Raw)
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+	"net/http"
+	"os"
+)
+
+//Create the ACME client that obtains and renews certificates for the config's
+//domains. Certificates and the account key are cached in the cache directory
+//so they survive restarts.
+func newACMEManager(config *ACMEConfig) (*autocert.Manager, error) {
+	client := &acme.Client{DirectoryURL: config.DirectoryURL}
+
+	if config.CARoot != "" {
+		//Trust a private CA for talking to the directory, e.g. a local Pebble
+		data, err := os.ReadFile(config.CARoot)
+		if err != nil {
+			return nil, err
+		}
+
+		roots := x509.NewCertPool()
+		if !roots.AppendCertsFromPEM(data) {
+			return nil, errors.New(config.CARoot + ": no PEM certificates found")
+		}
+
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.TLSClientConfig = &tls.Config{RootCAs: roots}
+		client.HTTPClient = &http.Client{Transport: transport}
+	}
+
+	return &autocert.Manager{Prompt: autocert.AcceptTOS,
+		Cache:      autocert.DirCache(config.CacheDir),
+		HostPolicy: autocert.HostWhitelist(config.Domains...),
+		Client:     client,
+		Email:      config.Email}, nil
+}
+
+//Used as tls.Config.GetCertificate. Clients connecting by IP address don't
+//send a name, so they get the certificate for the first domain.
+func acmeGetCertificate(manager *autocert.Manager, defaultDomain string) func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+		if hello.ServerName == "" {
+			named := *hello
+			named.ServerName = defaultDomain
+			hello = &named
+		}
+		return manager.GetCertificate(hello)
+	}
+}
+
+//Whether the handshake is a CA validating a TLS-ALPN-01 challenge
+func isACMEChallenge(hello *tls.ClientHelloInfo) bool {
+	for _, proto := range hello.SupportedProtos {
+		if proto == acme.ALPNProto {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+const (
+	//The most capability tokens we send in one CAP LS or CAP LIST line
+	capLineLength = 400
+
+	//Additional line length allowed for the tags section once message-tags is
+	//negotiated
+	tagsLength = 8191
+)
+
+//Handle a CAP command from a client
+func (s *Server) handleCap(client *Client, args []string) {
+	if len(args) < 1 {
+		client.reply(errMoreArgs)
+		return
+	}
+
+	subcommand := strings.ToUpper(args[0])
+
+	switch subcommand {
+	case "LS":
+		if client.registered == false {
+			client.capNegotiating = true
+		}
+
+		if len(args) > 1 {
+			if version, err := strconv.Atoi(args[1]); err == nil && version > client.capVersion {
+				client.capVersion = version
+			}
+		}
+
+		if client.capVersion >= 302 {
+			//cap-notify is implicitly enabled for clients using version 302
+			client.capMap["cap-notify"] = true
+		}
+
+		caps := make([]string, 0, len(s.capabilityMap))
+		for name, value := range s.capabilityMap {
+			if value != "" && client.capVersion >= 302 {
+				name += "=" + value
+			}
+			caps = append(caps, name)
+		}
+		client.replyCapList("LS", caps)
+
+	case "LIST":
+		caps := make([]string, 0, len(client.capMap))
+		for name := range client.capMap {
+			caps = append(caps, name)
+		}
+		client.replyCapList("LIST", caps)
+
+	case "REQ":
+		if len(args) < 2 {
+			client.reply(errMoreArgs)
+			return
+		}
+
+		if client.registered == false {
+			client.capNegotiating = true
+		}
+
+		//Requests are all or nothing, so check everything before changing anything
+		requested := strings.Fields(args[1])
+		for _, name := range requested {
+			enable := !strings.HasPrefix(name, "-")
+			name = strings.TrimPrefix(name, "-")
+
+			if _, exists := s.capabilityMap[name]; !exists {
+				client.reply(rplCap, "NAK", args[1])
+				return
+			}
+			if name == "cap-notify" && !enable && client.capVersion >= 302 {
+				client.reply(rplCap, "NAK", args[1])
+				return
+			}
+		}
+
+		for _, name := range requested {
+			if strings.HasPrefix(name, "-") {
+				delete(client.capMap, name[1:])
+			} else {
+				client.capMap[name] = true
+			}
+		}
+		client.updateLineLength()
+		client.reply(rplCap, "ACK", args[1])
+
+	case "END":
+		if client.registered || client.capNegotiating == false {
+			return
+		}
+
+		client.capNegotiating = false
+		client.abortSASL()
+		client.tryRegister()
+
+	default:
+		client.reply(errInvalidCapCmd, args[0])
+	}
+}
+
+//Advertise a new capability to the clients that want to hear about it
+func (s *Server) addCapability(name, value string) {
+	if oldValue, exists := s.capabilityMap[name]; exists && oldValue == value {
+		return
+	}
+
+	s.capabilityMap[name] = value
+
+	for _, client := range s.clientMap {
+		if client.capMap["cap-notify"] {
+			if value != "" && client.capVersion >= 302 {
+				client.reply(rplCap, "NEW", name+"="+value)
+			} else {
+				client.reply(rplCap, "NEW", name)
+			}
+		}
+	}
+}
+
+//Withdraw a capability, disabling it for every client
+func (s *Server) removeCapability(name string) {
+	if _, exists := s.capabilityMap[name]; !exists {
+		return
+	}
+
+	delete(s.capabilityMap, name)
+
+	for _, client := range s.clientMap {
+		if client.capMap["cap-notify"] {
+			client.reply(rplCap, "DEL", name)
+		}
+		delete(client.capMap, name)
+		client.updateLineLength()
+	}
+}
+
+//Send a list of capabilities, split over as many lines as needed
+func (c *Client) replyCapList(subcommand string, caps []string) {
+	sort.Strings(caps)
+
+	line := ""
+	for _, name := range caps {
+		if line != "" && len(line)+len(name)+1 > capLineLength {
+			if c.capVersion >= 302 {
+				c.reply(rplCapMore, subcommand, line)
+			} else {
+				c.reply(rplCap, subcommand, line)
+			}
+			line = ""
+		}
+
+		if line != "" {
+			line += " "
+		}
+		line += name
+	}
+
+	c.reply(rplCap, subcommand, line)
+}
+
+//Update the longest line the client may send to reflect its capabilities
+func (c *Client) updateLineLength() {
+	length := c.server.config.Load().Limits.LineLength
+	if c.capMap["message-tags"] {
+		length += tagsLength
+	}
+	atomic.StoreInt32(&c.maxLineLength, int32(length))
+}
+
+//Filter a set of tags down to those a client may send to another client
+func clientTags(tags map[string]string) map[string]string {
+	var filtered map[string]string
+	for key, value := range tags {
+		if strings.HasPrefix(key, "+") {
+			if filtered == nil {
+				filtered = make(map[string]string)
+			}
+			filtered[key] = value
+		}
+	}
+	return filtered
+}
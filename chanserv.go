@@ -0,0 +1,394 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+	"sort"
+	"strings"
+)
+
+const (
+	chanServ = "ChanServ"
+)
+
+//A channel registered to an account with ChanServ, which keeps its topic,
+//modes and access list when everybody leaves
+type RegisteredChannel struct {
+	name      string
+	founder   string //Name of the founder's account
+	topic     string
+	mode      ChannelMode
+	accessMap map[string]*ClientMode //Map of account names → modes granted on join
+}
+
+//How a registered channel is stored in the channel file
+type channelRecord struct {
+	Name    string            `json:"name"`
+	Founder string            `json:"founder"`
+	Topic   string            `json:"topic,omitempty"`
+	Modes   string            `json:"modes"`
+	Access  map[string]string `json:"access,omitempty"`
+}
+
+//Load the registered channels from the channel file. A missing file is
+//treated as empty, as it is created when the first channel is registered.
+func loadChannels(path string) (map[string]*RegisteredChannel, error) {
+	channels := make(map[string]*RegisteredChannel)
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return channels, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var records []channelRecord
+	if err := json.Unmarshal(data, &records); err != nil {
+		return nil, err
+	}
+
+	for _, record := range records {
+		channel := &RegisteredChannel{name: record.Name,
+			founder:   record.Founder,
+			topic:     record.Topic,
+			accessMap: make(map[string]*ClientMode)}
+		channel.mode.apply("+" + record.Modes)
+
+		for account, modes := range record.Access {
+			mode := new(ClientMode)
+			mode.apply("+" + modes)
+			channel.accessMap[strings.ToLower(account)] = mode
+		}
+
+		channels[strings.ToLower(channel.name)] = channel
+	}
+
+	return channels, nil
+}
+
+//Write the registered channels out to the channel file, replacing it
+//atomically so a crash can't leave it half written
+func saveChannels(path string, channels map[string]*RegisteredChannel) error {
+	records := make([]channelRecord, 0, len(channels))
+	for _, channel := range channels {
+		record := channelRecord{Name: channel.name,
+			Founder: channel.founder,
+			Topic:   channel.topic,
+			Modes:   channel.mode.String(),
+			Access:  make(map[string]string)}
+		for account, mode := range channel.accessMap {
+			record.Access[account] = mode.String()
+		}
+		records = append(records, record)
+	}
+	sort.Slice(records, func(i, j int) bool { return records[i].Name < records[j].Name })
+
+	data, err := json.MarshalIndent(records, "", "\t")
+	if err != nil {
+		return err
+	}
+
+	tmpPath := path + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
+
+//The modes an account is granted when it joins the channel
+func (r *RegisteredChannel) accessFor(account string) ClientMode {
+	if account == "" {
+		return ClientMode{}
+	}
+	if strings.ToLower(account) == strings.ToLower(r.founder) {
+		return ClientMode{operator: true}
+	}
+	if mode, exists := r.accessMap[strings.ToLower(account)]; exists {
+		return *mode
+	}
+	return ClientMode{}
+}
+
+//Save a channel's topic and modes if it's registered. If they can't be saved
+//the registration keeps its old topic and modes.
+func (s *Server) updateRegisteredChannel(channel *Channel) error {
+	registration, exists := s.registeredChannelMap[strings.ToLower(channel.name)]
+	if !exists {
+		return nil
+	}
+
+	oldTopic, oldMode := registration.topic, registration.mode
+	registration.topic = channel.topic
+	registration.mode = channel.mode
+	if err := s.saveRegisteredChannels(); err != nil {
+		registration.topic, registration.mode = oldTopic, oldMode
+		return err
+	}
+	return nil
+}
+
+//Write the registered channels to the channel file, logging any error
+func (s *Server) saveRegisteredChannels() error {
+	err := saveChannels(s.channelFile, s.registeredChannelMap)
+	if err != nil {
+		log.Printf("Error saving channel file: %s", err)
+	}
+	return err
+}
+
+//Give the user any modes their account is entitled to in the channel, and
+//tell the channel about it
+func (channel *Channel) applyAccess(c *Client) {
+	registration, exists := c.server.registeredChannelMap[strings.ToLower(channel.name)]
+	if !exists {
+		return
+	}
+
+	mode, inChannel := channel.modeMap[c.key]
+	if !inChannel {
+		return
+	}
+
+	access := registration.accessFor(c.account)
+	modeStr := ""
+	if access.operator && !mode.operator {
+		mode.operator = true
+		modeStr += "o"
+	}
+	if access.voice && !mode.voice {
+		mode.voice = true
+		modeStr += "v"
+	}
+	if modeStr == "" {
+		return
+	}
+
+	args := []string{chanServ, channel.name, "+" + modeStr}
+	for range modeStr {
+		args = append(args, c.nick)
+	}
+	for _, client := range channel.clientMap {
+		client.reply(rplMode, args...)
+	}
+}
+
+//Handle a command sent to ChanServ, either with /msg ChanServ or /cs
+func (s *Server) handleChanServ(client *Client, args []string) {
+	if len(args) < 1 {
+		args = []string{"HELP"}
+	}
+
+	command := strings.ToUpper(args[0])
+	if command == "HELP" {
+		client.serviceReply(chanServ, "ChanServ lets you register a channel to your account, keeping its topic, modes and operators when everybody leaves.")
+		client.serviceReply(chanServ, "REGISTER <#channel>                    - Register a channel you are an operator in")
+		client.serviceReply(chanServ, "DROP <#channel>                        - Unregister a channel you founded")
+		client.serviceReply(chanServ, "INFO <#channel>                        - Show a channel's registration")
+		client.serviceReply(chanServ, "ACCESS <#channel> LIST                 - List the channel's access list")
+		client.serviceReply(chanServ, "ACCESS <#channel> ADD <account> <o|v>  - Give an account op or voice on join")
+		client.serviceReply(chanServ, "ACCESS <#channel> DEL <account>        - Remove an account from the access list")
+		client.serviceReply(chanServ, "SYNC <#channel>                        - Give everyone in the channel the modes they're entitled to")
+		return
+	}
+
+	if len(args) < 2 {
+		client.serviceReply(chanServ, "Syntax: "+command+" <#channel>. Try HELP.")
+		return
+	}
+
+	channelKey := strings.ToLower(args[1])
+	registration, registered := s.registeredChannelMap[channelKey]
+
+	if command != "REGISTER" && !registered {
+		client.serviceReply(chanServ, args[1]+" is not registered.")
+		return
+	}
+
+	isFounder := registered && client.account != "" &&
+		strings.ToLower(client.account) == strings.ToLower(registration.founder)
+
+	switch command {
+	case "REGISTER":
+		if s.channelFile == "" {
+			client.serviceReply(chanServ, "Channel registration is disabled on this server.")
+			return
+		}
+
+		if client.account == "" {
+			client.serviceReply(chanServ, "You must be logged in to an account to register a channel.")
+			return
+		}
+
+		if registered {
+			client.serviceReply(chanServ, registration.name+" is already registered.")
+			return
+		}
+
+		channel, exists := s.channelMap[channelKey]
+		if !exists {
+			client.serviceReply(chanServ, args[1]+" does not exist.")
+			return
+		}
+
+		if mode, inChannel := channel.modeMap[client.key]; !inChannel || !mode.operator {
+			client.serviceReply(chanServ, "You must be an operator in "+channel.name+" to register it.")
+			return
+		}
+
+		s.registeredChannelMap[channelKey] = &RegisteredChannel{name: channel.name,
+			founder:   client.account,
+			topic:     channel.topic,
+			mode:      channel.mode,
+			accessMap: make(map[string]*ClientMode)}
+		if err := s.saveRegisteredChannels(); err != nil {
+			delete(s.registeredChannelMap, channelKey)
+			client.serviceReply(chanServ, "Registration failed, please try again later.")
+			return
+		}
+
+		client.serviceReply(chanServ, channel.name+" is now registered to your account, "+client.account+".")
+
+	case "DROP":
+		if !isFounder {
+			client.serviceReply(chanServ, "Access denied.")
+			return
+		}
+
+		delete(s.registeredChannelMap, channelKey)
+		if err := s.saveRegisteredChannels(); err != nil {
+			s.registeredChannelMap[channelKey] = registration
+			client.serviceReply(chanServ, "Dropping "+registration.name+" failed, please try again later.")
+			return
+		}
+
+		client.serviceReply(chanServ, registration.name+" has been dropped.")
+
+	case "INFO":
+		client.serviceReply(chanServ, "Information on "+registration.name+":")
+		client.serviceReply(chanServ, "Founder: "+registration.founder)
+		if mode := registration.mode.String(); mode != "" {
+			client.serviceReply(chanServ, "Modes:   +"+mode)
+		}
+		if registration.topic != "" {
+			client.serviceReply(chanServ, "Topic:   "+registration.topic)
+		}
+
+	case "ACCESS":
+		subcommand := "LIST"
+		if len(args) > 2 {
+			subcommand = strings.ToUpper(args[2])
+		}
+
+		switch subcommand {
+		case "LIST":
+			if !isFounder && !registration.accessFor(client.account).operator {
+				client.serviceReply(chanServ, "Access denied.")
+				return
+			}
+
+			accounts := make([]string, 0, len(registration.accessMap))
+			for account := range registration.accessMap {
+				accounts = append(accounts, account)
+			}
+			sort.Strings(accounts)
+
+			client.serviceReply(chanServ, "Access list for "+registration.name+":")
+			client.serviceReply(chanServ, registration.founder+" (founder)")
+			for _, account := range accounts {
+				client.serviceReply(chanServ, account+" +"+registration.accessMap[account].String())
+			}
+			client.serviceReply(chanServ, "End of access list.")
+
+		case "ADD":
+			if !isFounder {
+				client.serviceReply(chanServ, "Access denied.")
+				return
+			}
+
+			if len(args) < 5 {
+				client.serviceReply(chanServ, "Syntax: ACCESS <#channel> ADD <account> <o|v>")
+				return
+			}
+
+			account := s.accountMap[strings.ToLower(args[3])]
+			if account == nil {
+				client.serviceReply(chanServ, args[3]+" is not a registered account.")
+				return
+			}
+
+			mode := new(ClientMode)
+			mode.apply("+" + strings.TrimPrefix(args[4], "+"))
+			if mode.String() == "" {
+				client.serviceReply(chanServ, "Access must be one of the modes "+statusModes()+".")
+				return
+			}
+
+			accountKey := strings.ToLower(account.name)
+			oldMode, hadAccess := registration.accessMap[accountKey]
+			registration.accessMap[accountKey] = mode
+			if err := s.saveRegisteredChannels(); err != nil {
+				if hadAccess {
+					registration.accessMap[accountKey] = oldMode
+				} else {
+					delete(registration.accessMap, accountKey)
+				}
+				client.serviceReply(chanServ, "Changing the access list failed, please try again later.")
+				return
+			}
+
+			client.serviceReply(chanServ, account.name+" will now be given +"+mode.String()+" in "+registration.name+".")
+
+		case "DEL":
+			if !isFounder {
+				client.serviceReply(chanServ, "Access denied.")
+				return
+			}
+
+			if len(args) < 4 {
+				client.serviceReply(chanServ, "Syntax: ACCESS <#channel> DEL <account>")
+				return
+			}
+
+			accountKey := strings.ToLower(args[3])
+			oldMode, exists := registration.accessMap[accountKey]
+			if !exists {
+				client.serviceReply(chanServ, args[3]+" is not on the access list.")
+				return
+			}
+
+			delete(registration.accessMap, accountKey)
+			if err := s.saveRegisteredChannels(); err != nil {
+				registration.accessMap[accountKey] = oldMode
+				client.serviceReply(chanServ, "Changing the access list failed, please try again later.")
+				return
+			}
+
+			client.serviceReply(chanServ, args[3]+" has been removed from the access list of "+registration.name+".")
+
+		default:
+			client.serviceReply(chanServ, "Unknown ACCESS command "+subcommand+". Try HELP.")
+		}
+
+	case "SYNC":
+		if !isFounder && !registration.accessFor(client.account).operator {
+			client.serviceReply(chanServ, "Access denied.")
+			return
+		}
+
+		channel, exists := s.channelMap[channelKey]
+		if !exists {
+			client.serviceReply(chanServ, registration.name+" is empty.")
+			return
+		}
+
+		for _, member := range channel.clientMap {
+			channel.applyAccess(member)
+		}
+
+		client.serviceReply(chanServ, registration.name+" has been synchronised with its access list.")
+
+	default:
+		client.serviceReply(chanServ, "Unknown command "+command+". Try HELP.")
+	}
+}
@@ -1,14 +1,29 @@
 package main
 
 import (
-	"bytes"
+	"crypto/tls"
+	"errors"
 	"fmt"
+	"golang.org/x/crypto/bcrypt"
 	"io"
+	"net"
+	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 )
 
+//How long a client has to complete the TLS handshake
+const handshakeTimeout = 30 * time.Second
+
+//Longer usernames are truncated
+const maxUsernameLength = 10
+
 func (c *Client) setNick(nick string) {
+	if c.registered {
+		c.server.recordWhowas(c)
+	}
+
 	//Set up new nick
 	oldNick := c.nick
 	oldKey := c.key
@@ -19,8 +34,10 @@ func (c *Client) setNick(nick string) {
 	c.server.clientMap[c.key] = c
 
 	//Update the relevant channels and notify everyone who can see us about our
-	//nick change
-	c.reply(rplNickChange, oldNick, c.nick)
+	//nick change. Clients don't hear about their own nick until they register.
+	if c.registered {
+		c.reply(rplNickChange, oldNick, c.nick)
+	}
 	visited := make(map[*Client]struct{}, 100)
 	for _, channel := range c.channelMap {
 		delete(channel.clientMap, oldKey)
@@ -40,6 +57,13 @@ func (c *Client) setNick(nick string) {
 		channel.modeMap[c.key] = channel.modeMap[oldKey]
 		delete(channel.modeMap, oldKey)
 	}
+
+	if c.registered {
+		c.server.monitorOffline(oldNick)
+		c.server.monitorOnline(c)
+	}
+
+	c.checkNickOwnership()
 }
 
 func (c *Client) joinChannel(channelName string) {
@@ -48,9 +72,8 @@ func (c *Client) joinChannel(channelName string) {
 	channelKey := strings.ToLower(channelName)
 	channel, exists := c.server.channelMap[channelKey]
 	if exists == false {
-		mode := ChannelMode{secret: true,
-			topicLocked: true,
-			noExternal:  true}
+		var mode ChannelMode
+		mode.apply(c.server.config.Load().DefaultModes)
 		channel = &Channel{name: channelName,
 			topic:     "",
 			clientMap: make(map[string]*Client),
@@ -60,13 +83,29 @@ func (c *Client) joinChannel(channelName string) {
 		newChannel = true
 	}
 
+	registration, registered := c.server.registeredChannelMap[channelKey]
+	if newChannel && registered {
+		//Restore the registered channel as it was
+		channel.name = registration.name
+		channel.topic = registration.topic
+		channel.mode = registration.mode
+	}
+
 	if _, inChannel := channel.clientMap[c.key]; inChannel {
 		//Client is already in the channel, do nothing
 		return
 	}
 
+	if channel.mode.secureOnly && !c.secure {
+		if newChannel {
+			delete(c.server.channelMap, channelKey)
+		}
+		c.reply(errSecureOnly, channel.name)
+		return
+	}
+
 	mode := new(ClientMode)
-	if newChannel {
+	if newChannel && !registered {
 		//If they created the channel, make them op
 		mode.operator = true
 	}
@@ -76,38 +115,72 @@ func (c *Client) joinChannel(channelName string) {
 	c.channelMap[channelKey] = channel
 
 	for _, client := range channel.clientMap {
-		client.reply(rplJoin, c.nick, channel.name)
+		client.reply(rplJoin, c.nick, channel.name, c.account, c.realname)
+	}
+
+	//Peers with away-notify find out the newcomer is away straight away
+	if c.away != "" {
+		for _, client := range channel.clientMap {
+			if client != c && client.capMap["away-notify"] {
+				client.reply(rplAwayNotify, c.nick, c.away)
+			}
+		}
 	}
 
+	//Registered channels are never handed to whoever shows up first, instead
+	//ChanServ gives out modes according to the access list
+	channel.applyAccess(c)
+
 	if channel.topic != "" {
 		c.reply(rplTopic, channel.name, channel.topic)
 	} else {
 		c.reply(rplNoTopic, channel.name)
 	}
 
-	//The capacity sets the max number of nicks to send per message
-	nicks := make([]string, 0, 128)
+	c.sendNames(channel)
+	c.reply(rplEndOfNames, channel.name)
+}
 
-	for _, client := range channel.clientMap {
-		prefix := ""
+//Send the user the nicks of everybody in the channel, with their status
+//prefixes. Used by both JOIN and NAMES.
+func (c *Client) sendNames(channel *Channel) {
+	//Secret channels are marked as such
+	symbol := "="
+	if channel.mode.secret {
+		symbol = "@"
+	}
 
-		if mode, exists := channel.modeMap[client.key]; exists {
-			prefix = mode.Prefix()
-		}
+	//The capacity sets the max number of nicks to send per message
+	nicks := make([]string, 0, c.server.config.Load().Limits.NamesPerLine)
 
+	for _, client := range channel.clientMap {
 		if len(nicks) >= cap(nicks) {
-			c.reply(rplNames, channelName, strings.Join(nicks, " "))
+			c.reply(rplNames, symbol, channel.name, strings.Join(nicks, " "))
 			nicks = nicks[:0]
 		}
 
-		nicks = append(nicks, fmt.Sprintf("%s%s", prefix, client.nick))
+		name := client.nick
+		if c.capMap["userhost-in-names"] {
+			name = client.hostmask()
+		}
+		nicks = append(nicks, c.statusPrefix(channel.modeMap[client.key])+name)
 	}
 
 	if len(nicks) > 0 {
-		c.reply(rplNames, channelName, strings.Join(nicks, " "))
+		c.reply(rplNames, symbol, channel.name, strings.Join(nicks, " "))
 	}
+}
 
-	c.reply(rplEndOfNames, channelName)
+//The prefix shown to the user for somebody's channel status: every prefix
+//they have with multi-prefix, otherwise only the highest
+func (c *Client) statusPrefix(mode *ClientMode) string {
+	if mode == nil {
+		return ""
+	}
+	if c.capMap["multi-prefix"] {
+		return mode.Prefixes()
+	}
+	return mode.Prefix()
 }
 
 func (c *Client) partChannel(channelName, reason string) {
@@ -136,6 +209,291 @@ func (c *Client) partChannel(channelName, reason string) {
 	}
 }
 
+//Registration is a small state machine. A client starts out unregistered and
+//may send PASS, NICK, USER and CAP in any order. Once it has both a nick and a
+//username, and isn't negotiating capabilities, registration completes if it
+//sent the right connection password, and it's disconnected otherwise. After
+//that it may change its nick, but not send PASS or USER again.
+func (c *Client) tryRegister() {
+	if !c.connected || c.registered || c.nick == "" || c.username == "" || c.capNegotiating || c.checkingPassword {
+		return
+	}
+
+	if hash := c.server.config.Load().Password; hash != "" && !c.passwordAccepted {
+		c.checkPassword([]byte(hash), c.password, func(matched bool) {
+			if !matched {
+				c.reply(errPassword)
+				c.quit("Bad password")
+				return
+			}
+			c.passwordAccepted = true
+		})
+		return
+	}
+
+	c.register()
+}
+
+//Most wrong passwords a client may send before it's disconnected
+const maxFailedPasswords = 3
+
+//Check a password against a bcrypt hash, then call done on the server's
+//goroutine with whether it matched. bcrypt is slow by design, so it runs on
+//its own goroutine rather than holding up every other user, with no more
+//checks running at once than there are CPUs. A nil hash never matches. Only
+//one password is checked at a time, any sent meanwhile are treated as wrong,
+//and too many wrong passwords get the client disconnected. Registration waits
+//for the check to finish.
+func (c *Client) checkPassword(hash []byte, password string, done func(matched bool)) {
+	if c.checkingPassword {
+		done(false)
+		return
+	}
+	c.checkingPassword = true
+
+	go func() {
+		c.server.passwordSlots <- struct{}{}
+		//nil means the passwords matched
+		matched := hash != nil && bcrypt.CompareHashAndPassword(hash, []byte(password)) == nil
+		<-c.server.passwordSlots
+
+		c.server.eventChan <- Event{client: c, event: passwordChecked, callback: func() {
+			c.checkingPassword = false
+			done(matched)
+
+			if !matched {
+				c.failedPasswords++
+				if c.failedPasswords >= maxFailedPasswords {
+					c.quit("Too many failed password attempts")
+					return
+				}
+			}
+			c.tryRegister()
+		}}
+	}()
+}
+
+//Error given to hashPassword's done while another password is in progress
+var errPasswordBusy = errors.New("another password is being checked")
+
+//Hash a password with bcrypt, then call done on the server's goroutine with
+//the hash. Like checkPassword it runs on its own goroutine, sharing the same
+//limit on how many run at once, and only one runs at a time for each client.
+func (c *Client) hashPassword(password string, done func(hash []byte, err error)) {
+	if c.checkingPassword {
+		done(nil, errPasswordBusy)
+		return
+	}
+	c.checkingPassword = true
+
+	go func() {
+		c.server.passwordSlots <- struct{}{}
+		hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+		<-c.server.passwordSlots
+
+		c.server.eventChan <- Event{client: c, event: passwordChecked, callback: func() {
+			c.checkingPassword = false
+			done(hash, err)
+		}}
+	}()
+}
+
+//Complete registration once the client has provided everything we need
+func (c *Client) register() {
+	c.registered = true
+	c.registrationTimer.Stop()
+	c.signon = time.Now()
+	c.lastMessage = c.signon
+	c.password = ""
+
+	c.server.monitorOnline(c)
+
+	c.reply(rplWelcome)
+	c.reply(rplYourHost)
+	c.reply(rplCreated)
+	c.reply(rplMyInfo)
+	c.sendISupport()
+	c.sendLusers()
+	c.sendMOTD()
+
+	if c.certfp != "" {
+		c.reply(rplNotice, c.server.name, c.nick, "Your client certificate fingerprint is "+c.certfp)
+	}
+}
+
+//The only user mode is o, for operators
+const userModeLetters = "o"
+
+func (c *Client) userModes() string {
+	if c.operClass != nil {
+		return "+o"
+	}
+	return "+"
+}
+
+//Mark the user as away with the given message, or as back if it's empty, and
+//tell everybody with away-notify who shares a channel with them
+func (c *Client) setAway(message string) {
+	c.away = message
+	if message == "" {
+		c.reply(rplUnAway)
+	} else {
+		c.reply(rplNowAway)
+	}
+
+	visited := map[*Client]struct{}{c: {}}
+	for _, channel := range c.channelMap {
+		for _, client := range channel.clientMap {
+			if _, skip := visited[client]; skip {
+				continue
+			}
+			if client.capMap["away-notify"] {
+				client.reply(rplAwayNotify, c.nick, message)
+			}
+			visited[client] = struct{}{}
+		}
+	}
+}
+
+//Send the user statistics about the server's users and channels
+func (c *Client) sendLusers() {
+	users, operators, unknown := 0, 0, 0
+	for _, client := range c.server.clientMap {
+		if !client.registered {
+			unknown++
+			continue
+		}
+		users++
+		if client.operClass != nil {
+			operators++
+		}
+	}
+	if users > c.server.maxUsers {
+		c.server.maxUsers = users
+	}
+
+	userCount, maxCount := strconv.Itoa(users), strconv.Itoa(c.server.maxUsers)
+
+	c.reply(rplLuserClient, userCount)
+	if operators > 0 {
+		c.reply(rplLuserOp, strconv.Itoa(operators))
+	}
+	if unknown > 0 {
+		c.reply(rplLuserUnknown, strconv.Itoa(unknown))
+	}
+	if len(c.server.channelMap) > 0 {
+		c.reply(rplLuserChannels, strconv.Itoa(len(c.server.channelMap)))
+	}
+	c.reply(rplLuserMe, strconv.Itoa(users+unknown))
+	c.reply(rplLocalUsers, userCount, maxCount)
+	c.reply(rplGlobalUsers, userCount, maxCount)
+}
+
+//Send the user the message of the day, a line at a time with long lines split
+func (c *Client) sendMOTD() {
+	motd := strings.TrimRight(c.server.motd, "\n")
+	if motd == "" {
+		c.reply(errNoMOTD)
+		return
+	}
+
+	c.reply(rplMOTDStart)
+	for _, line := range strings.Split(motd, "\n") {
+		line = strings.TrimRight(line, "\r")
+		for len(line) > 80 {
+			c.reply(rplMOTD, line[:80])
+			line = line[80:]
+		}
+		c.reply(rplMOTD, line)
+	}
+	c.reply(rplEndOfMOTD)
+}
+
+//Check whether the user is an operator in the channel
+func (channel *Channel) isOperator(c *Client) bool {
+	mode, inChannel := channel.modeMap[c.key]
+	return inChannel && mode.operator
+}
+
+//Check whether the user may know the channel exists. Secret channels are
+//hidden from everybody outside them.
+func (channel *Channel) isVisibleTo(c *Client) bool {
+	if !channel.mode.secret || c.hasPrivilege(privSeeSecret) {
+		return true
+	}
+	_, inChannel := channel.clientMap[c.key]
+	return inChannel
+}
+
+//Check whether the user may send messages to the channel
+func (channel *Channel) canSpeak(c *Client) bool {
+	if c.hasPrivilege(privOverride) {
+		return true
+	}
+
+	clientMode, inChannel := channel.modeMap[c.key]
+	if channel.mode.noExternal && !inChannel {
+		//Not in channel, not allowed to send
+		return false
+	}
+	if channel.mode.moderated {
+		if !inChannel || (!clientMode.operator && !clientMode.voice) {
+			//It's moderated and we're not +v or +o
+			return false
+		}
+	}
+	return true
+}
+
+//Remove the user from the server straight away, telling everybody in their
+//channels why they quit and freeing their nick, then disconnect them. All
+//disconnections end up here, whoever started them.
+func (c *Client) quit(reason string) {
+	if !c.connected {
+		return
+	}
+
+	//Tell everybody who shares a channel with us, once each
+	visited := map[*Client]struct{}{c: {}}
+	for channelKey, channel := range c.channelMap {
+		for _, client := range channel.clientMap {
+			if _, skip := visited[client]; skip {
+				continue
+			}
+			client.reply(rplQuit, c.nick, reason)
+			visited[client] = struct{}{}
+		}
+
+		delete(channel.modeMap, c.key)
+		delete(channel.clientMap, c.key)
+		if len(channel.clientMap) == 0 {
+			delete(c.server.channelMap, channelKey)
+		}
+	}
+	c.channelMap = make(map[string]*Channel)
+
+	if c.registered {
+		c.server.recordWhowas(c)
+		c.server.monitorOffline(c.nick)
+	}
+	for key := range c.monitorMap {
+		c.unmonitor(key)
+	}
+
+	//Our nick may have been taken already, e.g. by GHOST
+	if c.server.clientMap[c.key] == c {
+		delete(c.server.clientMap, c.key)
+	}
+
+	if c.nickTimer != nil {
+		c.nickTimer.Stop()
+	}
+	c.registrationTimer.Stop()
+
+	c.reply(rplError, reason)
+	c.disconnect()
+}
+
 func (c *Client) disconnect() {
 	c.connected = false
 	c.signalChan <- signalStop
@@ -143,98 +501,304 @@ func (c *Client) disconnect() {
 
 //Send a reply to a user with the code specified
 func (c *Client) reply(code replyCode, args ...string) {
+	c.replyWithTags(nil, code, args...)
+}
+
+//Send a reply to a user with the code specified, carrying the given message
+//tags if the user has negotiated message-tags
+func (c *Client) replyWithTags(tags map[string]string, code replyCode, args ...string) {
 	if c.connected == false {
 		return
 	}
 
 	switch code {
 	case rplWelcome:
-		c.outputChan <- fmt.Sprintf(":%s 001 %s :Welcome to %s", c.server.name, c.nick, c.server.name)
+		c.sendNumeric("001", "Welcome to "+c.server.name)
+	case rplYourHost:
+		c.sendNumeric("002", "Your host is "+c.server.name+", running version "+VERSION)
+	case rplCreated:
+		c.sendNumeric("003", "This server was created "+c.server.created.Format(time.RFC1123))
+	case rplMyInfo:
+		c.sendNumeric("004", c.server.name, VERSION, userModeLetters, channelModeLetters()+statusModes(), statusModes())
+	case rplLuserClient:
+		c.sendNumeric("251", fmt.Sprintf("There are %s users and 0 invisible on 1 servers", args[0]))
+	case rplLuserOp:
+		c.sendNumeric("252", args[0], "operator(s) online")
+	case rplLuserUnknown:
+		c.sendNumeric("253", args[0], "unknown connection(s)")
+	case rplLuserChannels:
+		c.sendNumeric("254", args[0], "channels formed")
+	case rplLuserMe:
+		c.sendNumeric("255", fmt.Sprintf("I have %s clients and 0 servers", args[0]))
+	case rplLocalUsers:
+		c.sendNumeric("265", args[0], args[1], fmt.Sprintf("Current local users %s, max %s", args[0], args[1]))
+	case rplGlobalUsers:
+		c.sendNumeric("266", args[0], args[1], fmt.Sprintf("Current global users %s, max %s", args[0], args[1]))
+	case errNoMOTD:
+		c.sendNumeric("422", "MOTD File is missing")
+	case rplUModeIs:
+		c.sendNumeric("221", args[0])
+	case rplUMode:
+		c.sendMessage(tags, args[0], "MODE", args[0], args[1])
+	case errInvalidUsername:
+		c.sendNumeric("468", "Your username is invalid")
+	case rplQuit:
+		c.sendMessage(tags, args[0], "QUIT", args[1])
+	case rplError:
+		c.sendMessage(nil, "", "ERROR", "Closing link: "+args[0])
+	case rplWhoReply:
+		c.sendNumeric("352", args[0], args[1], args[2], c.server.name, args[3], args[4], "0 "+args[5])
+	case rplWhoxReply:
+		c.sendNumeric("354", args...)
+	case rplEndOfWho:
+		c.sendNumeric("315", args[0], "End of WHO list")
+	case rplWhoisUser:
+		c.sendNumeric("311", args[0], args[1], args[2], "*", args[3])
+	case rplWhoisChannels:
+		c.sendNumeric("319", args[0], args[1])
+	case rplWhoisServer:
+		c.sendNumeric("312", args[0], c.server.name, "Rosella IRCD")
+	case rplWhoisOperator:
+		c.sendNumeric("313", args[0], "is an IRC operator")
+	case rplWhoisAccount:
+		c.sendNumeric("330", args[0], args[1], "is logged in as")
+	case rplWhoisSecure:
+		c.sendNumeric("671", args[0], "is using a secure connection")
+	case rplWhoisCertfp:
+		c.sendNumeric("276", args[0], "has client certificate fingerprint "+args[1])
+	case rplWhoisListener:
+		c.sendNumeric("320", args[0], "is connected through a "+args[1]+" listener")
+	case rplWhoisIdle:
+		c.sendNumeric("317", args[0], args[1], args[2], "seconds idle, signon time")
+	case rplEndOfWhois:
+		c.sendNumeric("318", args[0], "End of WHOIS list")
+	case rplAway:
+		c.sendNumeric("301", args[0], args[1])
+	case rplUnAway:
+		c.sendNumeric("305", "You are no longer marked as being away")
+	case rplNowAway:
+		c.sendNumeric("306", "You have been marked as being away")
+	case rplAwayNotify:
+		if args[1] == "" {
+			c.sendMessage(tags, args[0], "AWAY")
+		} else {
+			c.sendMessage(tags, args[0], "AWAY", args[1])
+		}
+	case rplIsOn:
+		c.sendNumeric("303", args[0])
+	case rplUserhost:
+		c.sendNumeric("302", args[0])
+	case rplMonOnline:
+		c.sendNumeric("730", args[0])
+	case rplMonOffline:
+		c.sendNumeric("731", args[0])
+	case rplMonList:
+		c.sendNumeric("732", args[0])
+	case rplEndOfMonList:
+		c.sendNumeric("733", "End of MONITOR list")
+	case errMonListFull:
+		c.sendNumeric("734", args[0], args[1], "Monitor list is full")
+	case rplWhowasUser:
+		c.sendNumeric("314", args[0], args[1], args[2], "*", args[3])
+	case rplWhowasServer:
+		c.sendNumeric("312", args[0], c.server.name, args[1])
+	case rplEndOfWhowas:
+		c.sendNumeric("369", args[0], "End of WHOWAS")
+	case errWasNoSuchNick:
+		c.sendNumeric("406", args[0], "There was no such nickname")
+	case errUsersDontMatch:
+		c.sendNumeric("502", "Can't view modes for other users")
+	case rplISupport:
+		c.sendNumeric("005", append(args, "are supported by this server")...)
 	case rplJoin:
-		c.outputChan <- fmt.Sprintf(":%s JOIN %s", args[0], args[1])
+		if c.capMap["extended-join"] {
+			account := args[2]
+			if account == "" {
+				account = "*"
+			}
+			c.sendMessage(tags, args[0], "JOIN", args[1], account, args[3])
+		} else {
+			c.sendMessage(tags, args[0], "JOIN", args[1])
+		}
 	case rplPart:
-		c.outputChan <- fmt.Sprintf(":%s PART %s %s", args[0], args[1], args[2])
+		if args[2] == "" {
+			c.sendMessage(tags, args[0], "PART", args[1])
+		} else {
+			c.sendMessage(tags, args[0], "PART", args[1], args[2])
+		}
 	case rplTopic:
-		c.outputChan <- fmt.Sprintf(":%s 332 %s %s :%s", c.server.name, c.nick, args[0], args[1])
+		c.sendNumeric("332", args[0], args[1])
 	case rplNoTopic:
-		c.outputChan <- fmt.Sprintf(":%s 331 %s %s :No topic is set", c.server.name, c.nick, args[0])
+		c.sendNumeric("331", args[0], "No topic is set")
 	case rplNames:
-		c.outputChan <- fmt.Sprintf(":%s 353 %s = %s :%s", c.server.name, c.nick, args[0], args[1])
+		c.sendNumeric("353", args[0], args[1], args[2])
 	case rplEndOfNames:
-		c.outputChan <- fmt.Sprintf(":%s 366 %s %s :End of NAMES list", c.server.name, c.nick, args[0])
+		c.sendNumeric("366", args[0], "End of NAMES list")
 	case rplNickChange:
-		c.outputChan <- fmt.Sprintf(":%s NICK %s", args[0], args[1])
+		c.sendMessage(tags, args[0], "NICK", args[1])
 	case rplKill:
-		c.outputChan <- fmt.Sprintf(":%s KILL %s A %s", args[0], c.nick, args[1])
+		c.sendMessage(tags, args[0], "KILL", c.nick, args[1])
 	case rplMsg:
-		c.outputChan <- fmt.Sprintf(":%s PRIVMSG %s %s", args[0], args[1], args[2])
+		c.sendMessage(tags, args[0], "PRIVMSG", args[1], args[2])
 	case rplList:
-		c.outputChan <- fmt.Sprintf(":%s 322 %s %s", c.server.name, c.nick, args[0])
+		c.sendNumeric("322", args[0], args[1], args[2])
 	case rplListEnd:
-		c.outputChan <- fmt.Sprintf(":%s 323 %s", c.server.name, c.nick)
+		c.sendNumeric("323", "End of LIST")
 	case rplOper:
-		c.outputChan <- fmt.Sprintf(":%s 381 %s :You are now an operator", c.server.name, c.nick)
+		c.sendNumeric("381", "You are now an operator")
 	case rplChannelModeIs:
-		c.outputChan <- fmt.Sprintf(":%s 324 %s %s %s %s", c.server.name, c.nick, args[0], args[1], args[2])
+		if args[2] == "" {
+			c.sendNumeric("324", args[0], args[1])
+		} else {
+			c.sendNumeric("324", args[0], args[1], args[2])
+		}
 	case rplKick:
-		c.outputChan <- fmt.Sprintf(":%s KICK %s %s %s", args[0], args[1], args[2], args[3])
+		if args[3] == "" {
+			c.sendMessage(tags, args[0], "KICK", args[1], args[2])
+		} else {
+			c.sendMessage(tags, args[0], "KICK", args[1], args[2], args[3])
+		}
 	case rplInfo:
-		c.outputChan <- fmt.Sprintf(":%s 371 %s :%s", c.server.name, c.nick, args[0])
+		c.sendNumeric("371", args[0])
 	case rplVersion:
-		c.outputChan <- fmt.Sprintf(":%s 351 %s %s", c.server.name, c.nick, args[0])
+		c.sendNumeric("351", args[0])
 	case rplMOTDStart:
-		c.outputChan <- fmt.Sprintf(":%s 375 %s :- Message of the day - ", c.server.name, c.nick)
+		c.sendNumeric("375", "- Message of the day - ")
 	case rplMOTD:
-		c.outputChan <- fmt.Sprintf(":%s 372 %s :- %s", c.server.name, c.nick, args[0])
+		c.sendNumeric("372", "- "+args[0])
 	case rplEndOfMOTD:
-		c.outputChan <- fmt.Sprintf(":%s 376 %s :End of MOTD Command", c.server.name, c.nick)
+		c.sendNumeric("376", "End of MOTD Command")
 	case rplPong:
-		c.outputChan <- fmt.Sprintf(":%s PONG %s %s", c.server.name, c.nick, c.server.name)
+		c.sendMessage(tags, c.server.name, "PONG", c.server.name, args[0])
+	case rplPing:
+		c.sendMessage(nil, "", "PING", args[0])
+	case errNoOrigin:
+		c.sendNumeric("409", "No origin specified")
 	case errMoreArgs:
-		c.outputChan <- fmt.Sprintf(":%s 461 %s :Not enough params", c.server.name, c.nick)
+		c.sendNumeric("461", "Not enough params")
 	case errNoNick:
-		c.outputChan <- fmt.Sprintf(":%s 431 %s :No nickname given", c.server.name, c.nick)
+		c.sendNumeric("431", "No nickname given")
 	case errInvalidNick:
-		c.outputChan <- fmt.Sprintf(":%s 432 %s %s :Erronenous nickname", c.server.name, c.nick, args[0])
+		c.sendNumeric("432", args[0], "Erronenous nickname")
 	case errNickInUse:
-		c.outputChan <- fmt.Sprintf(":%s 433 %s %s :Nick already in use", c.server.name, c.nick, args[0])
+		c.sendNumeric("433", args[0], "Nick already in use")
 	case errAlreadyReg:
-		c.outputChan <- fmt.Sprintf(":%s 462 :You need a valid nick first", c.server.name)
+		c.sendNumeric("462", "You may not reregister")
 	case errNoSuchNick:
-		c.outputChan <- fmt.Sprintf(":%s 401 %s %s :No such nick/channel", c.server.name, c.nick, args[0])
+		c.sendNumeric("401", args[0], "No such nick/channel")
 	case errUnknownCommand:
-		c.outputChan <- fmt.Sprintf(":%s 421 %s %s :Unknown command", c.server.name, c.nick, args[0])
+		c.sendNumeric("421", args[0], "Unknown command")
 	case errNotReg:
-		c.outputChan <- fmt.Sprintf(":%s 451 :You have not registered", c.server.name)
+		c.sendNumeric("451", "You have not registered")
 	case errPassword:
-		c.outputChan <- fmt.Sprintf(":%s 464 %s :Error, password incorrect", c.server.name, c.nick)
+		c.sendNumeric("464", "Error, password incorrect")
 	case errNoPriv:
-		c.outputChan <- fmt.Sprintf(":%s 481 %s :Permission denied", c.server.name, c.nick)
+		c.sendNumeric("481", "Permission denied")
 	case errCannotSend:
-		c.outputChan <- fmt.Sprintf(":%s 404 %s %s :Cannot send to channel", c.server.name, c.nick, args[0])
+		c.sendNumeric("404", args[0], "Cannot send to channel")
+	case errTooManyTargets:
+		c.sendNumeric("407", args[0], "Too many recipients")
+	case errSecureOnly:
+		c.sendNumeric("489", args[0], "Cannot join channel (+Z) - you need to use a secure connection")
+	case errInputTooLong:
+		c.sendNumeric("417", "Input line was too long")
+	case rplCap:
+		c.sendMessage(tags, c.server.name, "CAP", c.target(), args[0], args[1])
+	case rplCapMore:
+		c.sendMessage(tags, c.server.name, "CAP", c.target(), args[0], "*", args[1])
+	case errInvalidCapCmd:
+		c.sendNumeric("410", args[0], "Invalid CAP command")
+	case rplTagMsg:
+		c.sendMessage(tags, args[0], "TAGMSG", args[1])
+	case rplNotice:
+		c.sendMessage(tags, args[0], "NOTICE", args[1], args[2])
+	case rplAccount:
+		c.sendMessage(tags, args[0], "ACCOUNT", args[1])
+	case rplMode:
+		c.sendMessage(tags, args[0], "MODE", args[1:]...)
+	case rplRehashing:
+		c.sendNumeric("382", args[0], "Rehashing")
+	case rplAuthenticate:
+		c.sendMessage(tags, "", "AUTHENTICATE", args[0])
+	case rplLoggedIn:
+		c.sendNumeric("900", c.hostmask(), args[0], "You are now logged in as "+args[0])
+	case rplSASLSuccess:
+		c.sendNumeric("903", "SASL authentication successful")
+	case errSASLFail:
+		c.sendNumeric("904", "SASL authentication failed")
+	case errSASLTooLong:
+		c.sendNumeric("905", "SASL message too long")
+	case errSASLAborted:
+		c.sendNumeric("906", "SASL authentication aborted")
+	case errSASLAlready:
+		c.sendNumeric("907", "You have already authenticated using SASL")
+	case rplSASLMechs:
+		c.sendNumeric("908", args[0], "are available SASL mechanisms")
+	}
+}
+
+//Send a message from the given source to the user
+func (c *Client) sendMessage(tags map[string]string, source, command string, params ...string) {
+	if c.capMap["message-tags"] == false {
+		tags = nil
+	}
+	msg := Message{tags: tags, source: source, command: command, params: params}
+	c.outputChan <- msg.String()
+}
+
+//Send a numeric reply from the server, addressed to the user
+func (c *Client) sendNumeric(numeric string, params ...string) {
+	c.sendMessage(nil, c.server.name, numeric, append([]string{c.target()}, params...)...)
+}
+
+//The user's nick as the target of a reply, or * if they don't have one yet
+func (c *Client) target() string {
+	if c.nick == "" {
+		return "*"
 	}
+	return c.nick
 }
 
 func (c *Client) clientThread() {
 	readSignalChan := make(chan signalCode, 3)
 	writeSignalChan := make(chan signalCode, 3)
-	writeChan := make(chan string, 100)
+	writeChan := make(chan string, c.server.config.Load().Limits.SendQueue)
+
+	//Finish the handshake first, so the client certificate is known before
+	//the server hears about the client
+	if tlsConn, ok := c.connection.(*tls.Conn); ok {
+		tlsConn.SetDeadline(time.Now().Add(handshakeTimeout))
+		if err := tlsConn.Handshake(); err != nil {
+			c.connection.Close()
+			return
+		}
+		tlsConn.SetDeadline(time.Time{})
+		c.certfp = certFingerprint(c.connection)
+	}
 
 	c.server.eventChan <- Event{client: c, event: connected}
 
-	go c.readThread(readSignalChan)
-	go c.writeThread(writeSignalChan, writeChan)
-
-	defer func() {
-		//Part from all channels
-		for channelName := range c.channelMap {
-			c.partChannel(channelName, "Disconnecting")
+	//The reader and writer report why the connection failed, and each only
+	//does so once
+	errorChan := make(chan string, 2)
+	writeDone := make(chan struct{})
+	go c.readThread(readSignalChan, errorChan)
+	go c.writeThread(writeSignalChan, writeChan, errorChan, writeDone)
+
+	defer c.connection.Close()
+
+	//Set once the server has been told the connection is gone
+	reported := false
+	report := func(reason string) {
+		if !reported {
+			reported = true
+			//Sent from another goroutine, as the server may be waiting to
+			//send us output in the meantime
+			go func() {
+				c.server.eventChan <- Event{client: c, event: disconnected, input: reason}
+			}()
 		}
-
-		delete(c.server.clientMap, c.key)
-
-		c.connection.Close()
-	}()
+	}
 
 	for {
 		select {
@@ -242,21 +806,25 @@ func (c *Client) clientThread() {
 			if signal == signalStop {
 				readSignalChan <- signalStop
 				writeSignalChan <- signalStop
+				<-writeDone
 				return
 			}
+		case reason := <-errorChan:
+			report(reason)
 		case line := <-c.outputChan:
 			select {
 			case writeChan <- line:
 				continue
 			default:
-				c.disconnect()
+				report("Max SendQ exceeded")
 			}
 		}
 	}
 
 }
 
-func (c *Client) readThread(signalChan chan signalCode) {
+func (c *Client) readThread(signalChan chan signalCode, errorChan chan string) {
+	reader := newLineReader(c.connection)
 	for {
 		select {
 		case signal := <-signalChan:
@@ -265,42 +833,58 @@ func (c *Client) readThread(signalChan chan signalCode) {
 			}
 		default:
 			c.connection.SetReadDeadline(time.Now().Add(time.Second * 3))
-			buf := make([]byte, 512)
-			ln, err := c.connection.Read(buf)
-			if err != nil {
-				if err == io.EOF {
-					c.disconnect()
-					return
-				}
+			line, err := reader.readLine(int(atomic.LoadInt32(&c.maxLineLength)))
+			if err == errLineTooLong {
+				c.server.eventChan <- Event{client: c, event: inputTooLong}
 				continue
 			}
-
-			rawLines := buf[:ln]
-			rawLines = bytes.Replace(rawLines, []byte("\r\n"), []byte("\n"), -1)
-			rawLines = bytes.Replace(rawLines, []byte("\r"), []byte("\n"), -1)
-			lines := bytes.Split(rawLines, []byte("\n"))
-			for _, line := range lines {
-				if len(line) > 0 {
-					c.server.eventChan <- Event{client: c, event: command, input: string(line)}
+			if err != nil {
+				if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+					continue
 				}
+				if err == io.EOF || err == io.ErrUnexpectedEOF {
+					errorChan <- "Connection closed"
+				} else {
+					errorChan <- "Read error"
+				}
+				return
 			}
+
+			c.server.eventChan <- Event{client: c, event: command, input: string(line)}
 		}
 	}
 }
 
-func (c *Client) writeThread(signalChan chan signalCode, outputChan chan string) {
+func (c *Client) writeThread(signalChan chan signalCode, outputChan chan string, errorChan chan string, done chan struct{}) {
+	defer close(done)
 	for {
 		select {
 		case signal := <-signalChan:
 			if signal == signalStop {
-				return
+				//Send whatever is still queued, such as the ERROR explaining
+				//why the client is being disconnected
+				for {
+					select {
+					case output := <-outputChan:
+						if c.write(output) != nil {
+							return
+						}
+					default:
+						return
+					}
+				}
 			}
 		case output := <-outputChan:
-			c.connection.SetWriteDeadline(time.Now().Add(time.Second * 30))
-			if _, err := fmt.Fprintf(c.connection, "%s\r\n", output); err != nil {
-				c.disconnect()
+			if err := c.write(output); err != nil {
+				errorChan <- "Write error"
 				return
 			}
 		}
 	}
 }
+
+func (c *Client) write(line string) error {
+	c.connection.SetWriteDeadline(time.Now().Add(c.server.config.Load().Limits.WriteTimeout))
+	_, err := fmt.Fprintf(c.connection, "%s\r\n", line)
+	return err
+}
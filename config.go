@@ -0,0 +1,529 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/acme/autocert"
+	"golang.org/x/crypto/bcrypt"
+	"gopkg.in/yaml.v3"
+	"io"
+	"log"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//Rosella's configuration, as read from the config file. Anything not set in
+//the file keeps the value from defaultConfig.
+type Config struct {
+	Name         string           `yaml:"name"`
+	MOTD         string           `yaml:"motd"`
+	MOTDFile     string           `yaml:"motd-file"` //Takes precedence over motd
+	AuthFile     string           `yaml:"auth-file"`
+	AccountFile  string           `yaml:"account-file"`
+	ChannelFile  string           `yaml:"channel-file"`
+	DefaultModes string           `yaml:"default-modes"`
+	Password     string           `yaml:"password"` //bcrypt hashed connection password, required with PASS if set
+	Listeners    []ListenerConfig `yaml:"listeners"`
+	TLS          TLSConfig        `yaml:"tls"`
+	Limits       LimitsConfig     `yaml:"limits"`
+	Operators    []OperatorConfig `yaml:"operators"`
+
+	//Map of operator class names → privileges
+	OperClasses map[string][]string `yaml:"oper-classes"`
+}
+
+type ListenerConfig struct {
+	Address string `yaml:"address"` //host:port, or a socket path for unix listeners
+	Type    string `yaml:"type"`    //tls, plaintext or unix. Defaults to tls.
+	Secure  bool   `yaml:"secure"`  //Treat plaintext connections as secure, e.g. from a Tor onion service
+
+	//Ask TLS clients for a certificate, for SASL EXTERNAL and certfp operators
+	ClientCerts bool `yaml:"client-certs"`
+}
+
+type TLSConfig struct {
+	Cert         string              `yaml:"cert"`
+	Key          string              `yaml:"key"`
+	Certificates []CertificateConfig `yaml:"certificates"`  //Further certificates, chosen by SNI
+	MinVersion   string              `yaml:"min-version"`   //1.2 or 1.3
+	CipherSuites []string            `yaml:"cipher-suites"` //TLS 1.2 suites, TLS 1.3's are always enabled
+	Curves       []string            `yaml:"curves"`        //Empty for crypto/tls's defaults
+	ACME         ACMEConfig          `yaml:"acme"`
+}
+
+//Obtaining certificates automatically with ACME. If enabled, the certificates
+//given in the TLS config are not used.
+type ACMEConfig struct {
+	Domains      []string `yaml:"domains"`    //Empty disables ACME
+	Email        string   `yaml:"email"`      //Contact address given to the CA
+	AcceptTOS    bool     `yaml:"accept-tos"` //Must be set to agree to the CA's terms of service
+	DirectoryURL string   `yaml:"directory-url"`
+	CARoot       string   `yaml:"ca-root"`   //PEM file of roots to trust for the directory, for testing
+	CacheDir     string   `yaml:"cache-dir"` //Where certificates and the account key are kept
+}
+
+type CertificateConfig struct {
+	Cert string `yaml:"cert"`
+	Key  string `yaml:"key"`
+}
+
+//Longest line-length that may be configured, matching the length allowed for
+//tags
+const maxLineLengthLimit = 8191
+
+type LimitsConfig struct {
+	LineLength      int           `yaml:"line-length"`      //Longest line a client may send, excluding tags
+	NamesPerLine    int           `yaml:"names-per-line"`   //Most nicks sent in one NAMES reply
+	SendQueue       int           `yaml:"send-queue"`       //Lines queued for a client before it is disconnected
+	WriteTimeout    time.Duration `yaml:"write-timeout"`    //How long a write to a client may take
+	IdentifyTimeout time.Duration `yaml:"identify-timeout"` //How long a user has to identify for a registered nick
+	MaxTargets      int           `yaml:"max-targets"`      //Most targets of a single PRIVMSG, NOTICE or TAGMSG
+	NickLength      int           `yaml:"nick-length"`      //Longest nick a user may take
+	ChannelLength   int           `yaml:"channel-length"`   //Longest channel name, including the #
+
+	RegistrationTimeout time.Duration `yaml:"registration-timeout"` //How long a client has to register
+	PingInterval        time.Duration `yaml:"ping-interval"`        //How long a user may be idle before they're pinged
+	PingTimeout         time.Duration `yaml:"ping-timeout"`         //How long a user has to answer a ping
+
+	WhowasSize   int           `yaml:"whowas-size"`   //Most nicks remembered for WHOWAS
+	WhowasExpiry time.Duration `yaml:"whowas-expiry"` //How long nicks are remembered for WHOWAS
+	MonitorLimit int           `yaml:"monitor-limit"` //Most nicks a user may MONITOR
+}
+
+//An operator given directly in the config file, rather than in the auth file
+type OperatorConfig struct {
+	Name     string `yaml:"name"`
+	Password string `yaml:"password"` //bcrypt hashed, or certfp: and a fingerprint
+	Class    string `yaml:"class"`
+}
+
+func defaultConfig() *Config {
+	return &Config{Name: "rosella",
+		MOTD:         "Welcome to IRC. Powered by Rosella.",
+		DefaultModes: "+stn",
+		Listeners:    []ListenerConfig{{Address: ":6697"}},
+		TLS: TLSConfig{Cert: "tls.crt",
+			Key:        "tls.key",
+			MinVersion: "1.2",
+			CipherSuites: []string{
+				"TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384",
+				"TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384",
+				"TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256",
+				"TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256",
+				"TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256",
+				"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256"},
+			ACME: ACMEConfig{DirectoryURL: autocert.DefaultACMEDirectory,
+				CacheDir: "acme"}},
+		Limits: LimitsConfig{LineLength: 512,
+			NamesPerLine:    128,
+			SendQueue:       100,
+			WriteTimeout:    30 * time.Second,
+			IdentifyTimeout: 60 * time.Second,
+			MaxTargets:      4,
+			NickLength:      30,
+			ChannelLength:   50,
+
+			RegistrationTimeout: 60 * time.Second,
+			PingInterval:        90 * time.Second,
+			PingTimeout:         120 * time.Second,
+
+			WhowasSize:   100,
+			WhowasExpiry: 30 * time.Minute,
+			MonitorLimit: 100},
+		OperClasses: map[string][]string{
+			defaultOperClass: {"kill", "rehash", "see-secret", "override"}}}
+}
+
+//Load the config file at path. An empty path gives the default config.
+func loadConfig(path string) (*Config, error) {
+	config := defaultConfig()
+	if path == "" {
+		return config, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var root yaml.Node
+	if err := yaml.Unmarshal(data, &root); err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+
+	if len(root.Content) > 0 {
+		//Unknown keys are almost always typos, so refuse to start rather than
+		//silently ignore them
+		if err := checkConfigKeys(root.Content[0], reflect.TypeOf(*config), ""); err != nil {
+			return nil, fmt.Errorf("%s: %s", path, err)
+		}
+
+		decoder := yaml.NewDecoder(bytes.NewReader(data))
+		if err := decoder.Decode(config); err != nil && err != io.EOF {
+			return nil, fmt.Errorf("%s: %s", path, err)
+		}
+	}
+
+	if err := config.validate(); err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+
+	return config, nil
+}
+
+//Check every key in the YAML document corresponds to a config field, and that
+//every value has the right type, so errors can name the offending key
+func checkConfigKeys(node *yaml.Node, t reflect.Type, path string) error {
+	switch t.Kind() {
+	case reflect.Struct:
+		if node.Kind != yaml.MappingNode {
+			return fmt.Errorf("%s: expected a mapping (line %d)", configPath(path), node.Line)
+		}
+
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			key, value := node.Content[i], node.Content[i+1]
+
+			field, found := configField(t, key.Value)
+			if !found {
+				return fmt.Errorf("%s: unknown key (line %d)", joinConfigPath(path, key.Value), key.Line)
+			}
+			if err := checkConfigKeys(value, field.Type, joinConfigPath(path, key.Value)); err != nil {
+				return err
+			}
+		}
+
+	case reflect.Slice:
+		if node.Kind != yaml.SequenceNode {
+			return fmt.Errorf("%s: expected a list (line %d)", configPath(path), node.Line)
+		}
+
+		for i, item := range node.Content {
+			if err := checkConfigKeys(item, t.Elem(), fmt.Sprintf("%s[%d]", path, i)); err != nil {
+				return err
+			}
+		}
+
+	case reflect.Map:
+		if node.Kind != yaml.MappingNode {
+			return fmt.Errorf("%s: expected a mapping (line %d)", configPath(path), node.Line)
+		}
+
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			key, value := node.Content[i], node.Content[i+1]
+			if err := checkConfigKeys(value, t.Elem(), joinConfigPath(path, key.Value)); err != nil {
+				return err
+			}
+		}
+
+	case reflect.String:
+		if node.Kind != yaml.ScalarNode {
+			return fmt.Errorf("%s: expected a string (line %d)", configPath(path), node.Line)
+		}
+
+	case reflect.Int, reflect.Int64:
+		if t == reflect.TypeOf(time.Duration(0)) {
+			if _, err := time.ParseDuration(node.Value); node.Kind != yaml.ScalarNode || err != nil {
+				return fmt.Errorf("%s: expected a duration such as 30s (line %d)", configPath(path), node.Line)
+			}
+		} else if _, err := strconv.Atoi(node.Value); node.Kind != yaml.ScalarNode || err != nil {
+			return fmt.Errorf("%s: expected a number (line %d)", configPath(path), node.Line)
+		}
+
+	case reflect.Bool:
+		if _, err := strconv.ParseBool(node.Value); node.Kind != yaml.ScalarNode || err != nil {
+			return fmt.Errorf("%s: expected true or false (line %d)", configPath(path), node.Line)
+		}
+	}
+
+	return nil
+}
+
+//Find the struct field with the given yaml key
+func configField(t reflect.Type, key string) (reflect.StructField, bool) {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if strings.Split(field.Tag.Get("yaml"), ",")[0] == key {
+			return field, true
+		}
+	}
+	return reflect.StructField{}, false
+}
+
+func joinConfigPath(path, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
+
+func configPath(path string) string {
+	if path == "" {
+		return "top level"
+	}
+	return path
+}
+
+//Check the config's values make sense, naming the offending key if not
+func (c *Config) validate() error {
+	if c.Name == "" || strings.ContainsAny(c.Name, " :!@") {
+		return errors.New("name: must be non-empty, without spaces, colons, ! or @")
+	}
+
+	if c.DefaultModes != "" {
+		if !strings.HasPrefix(c.DefaultModes, "+") || strings.Trim(c.DefaultModes[1:], channelModeLetters()) != "" {
+			return fmt.Errorf("default-modes: %q is not a list of channel modes such as +stn", c.DefaultModes)
+		}
+	}
+
+	if c.Password != "" {
+		if _, err := bcrypt.Cost([]byte(c.Password)); err != nil {
+			return errors.New("password: must be a bcrypt hash")
+		}
+	}
+
+	if len(c.Listeners) == 0 {
+		return errors.New("listeners: at least one listener is required")
+	}
+	for i, listener := range c.Listeners {
+		if listener.Address == "" {
+			return fmt.Errorf("listeners[%d].address: must be set", i)
+		}
+
+		kind, exists := listenerTypeNames[listener.Type]
+		if !exists && listener.Type != "" {
+			return fmt.Errorf("listeners[%d].type: unknown listener type %q, expected tls, plaintext or unix", i, listener.Type)
+		}
+		if kind == listenerPlaintext {
+			if err := checkLoopbackAddress(listener.Address); err != nil {
+				return fmt.Errorf("listeners[%d].address: %s", i, err)
+			}
+		}
+		if kind != listenerTLS && listener.ClientCerts {
+			return fmt.Errorf("listeners[%d].client-certs: only TLS listeners can ask for client certificates", i)
+		}
+	}
+
+	if hasTLSListener(c.Listeners) && len(c.TLS.ACME.Domains) == 0 {
+		if c.TLS.Cert == "" {
+			return errors.New("tls.cert: must be set")
+		}
+		if c.TLS.Key == "" {
+			return errors.New("tls.key: must be set")
+		}
+	}
+	for i, certificate := range c.TLS.Certificates {
+		if certificate.Cert == "" || certificate.Key == "" {
+			return fmt.Errorf("tls.certificates[%d]: cert and key must both be set", i)
+		}
+	}
+	if _, exists := tlsVersionNames[c.TLS.MinVersion]; !exists {
+		return fmt.Errorf("tls.min-version: unknown TLS version %q, expected 1.2 or 1.3", c.TLS.MinVersion)
+	}
+	if len(c.TLS.CipherSuites) == 0 && c.TLS.MinVersion != "1.3" {
+		return errors.New("tls.cipher-suites: at least one cipher suite is required unless min-version is 1.3")
+	}
+	for i, name := range c.TLS.CipherSuites {
+		if _, exists := cipherSuiteID(name); !exists {
+			return fmt.Errorf("tls.cipher-suites[%d]: unknown TLS 1.2 cipher suite %q", i, name)
+		}
+	}
+	for i, name := range c.TLS.Curves {
+		if _, exists := curveNames[name]; !exists {
+			return fmt.Errorf("tls.curves[%d]: unknown curve %q, expected X25519, P-256, P-384 or P-521", i, name)
+		}
+	}
+	if len(c.TLS.ACME.Domains) > 0 {
+		if !c.TLS.ACME.AcceptTOS {
+			return errors.New("tls.acme.accept-tos: must be true to agree to the CA's terms of service")
+		}
+		if c.TLS.ACME.DirectoryURL == "" {
+			return errors.New("tls.acme.directory-url: must be set")
+		}
+		if c.TLS.ACME.CacheDir == "" {
+			return errors.New("tls.acme.cache-dir: must be set")
+		}
+	}
+
+	if c.Limits.LineLength < 512 || c.Limits.LineLength > maxLineLengthLimit {
+		return fmt.Errorf("limits.line-length: must be between 512 and %d, got %d", maxLineLengthLimit, c.Limits.LineLength)
+	}
+	if c.Limits.NamesPerLine < 1 {
+		return fmt.Errorf("limits.names-per-line: must be at least 1, got %d", c.Limits.NamesPerLine)
+	}
+	if c.Limits.SendQueue < 1 {
+		return fmt.Errorf("limits.send-queue: must be at least 1, got %d", c.Limits.SendQueue)
+	}
+	if c.Limits.WriteTimeout <= 0 {
+		return errors.New("limits.write-timeout: must be positive")
+	}
+	if c.Limits.IdentifyTimeout <= 0 {
+		return errors.New("limits.identify-timeout: must be positive")
+	}
+	if c.Limits.MaxTargets < 1 {
+		return fmt.Errorf("limits.max-targets: must be at least 1, got %d", c.Limits.MaxTargets)
+	}
+	//Users who don't identify for a registered nick are renamed to Guest12345
+	if c.Limits.NickLength < 10 {
+		return fmt.Errorf("limits.nick-length: must be at least 10, got %d", c.Limits.NickLength)
+	}
+	if c.Limits.ChannelLength < 2 {
+		return fmt.Errorf("limits.channel-length: must be at least 2, got %d", c.Limits.ChannelLength)
+	}
+	if c.Limits.RegistrationTimeout <= 0 {
+		return errors.New("limits.registration-timeout: must be positive")
+	}
+	if c.Limits.PingInterval < pingCheckInterval {
+		return fmt.Errorf("limits.ping-interval: must be at least %s", pingCheckInterval)
+	}
+	if c.Limits.PingTimeout < pingCheckInterval {
+		return fmt.Errorf("limits.ping-timeout: must be at least %s", pingCheckInterval)
+	}
+	if c.Limits.WhowasSize < 0 {
+		return fmt.Errorf("limits.whowas-size: must not be negative, got %d", c.Limits.WhowasSize)
+	}
+	if c.Limits.WhowasExpiry <= 0 {
+		return errors.New("limits.whowas-expiry: must be positive")
+	}
+	if c.Limits.MonitorLimit < 1 {
+		return fmt.Errorf("limits.monitor-limit: must be at least 1, got %d", c.Limits.MonitorLimit)
+	}
+
+	for name, privileges := range c.OperClasses {
+		for i, privilege := range privileges {
+			if _, exists := operPrivilegeNames[privilege]; !exists {
+				return fmt.Errorf("oper-classes.%s[%d]: unknown privilege %q, expected one of %s", name, i, privilege, operPrivilegeList())
+			}
+		}
+	}
+
+	for i, operator := range c.Operators {
+		if operator.Name == "" || strings.ContainsAny(operator.Name, " ") {
+			return fmt.Errorf("operators[%d].name: must be non-empty, without spaces", i)
+		}
+		if err := checkOperatorPassword(operator.Password); err != nil {
+			return fmt.Errorf("operators[%d].password: %s", i, err)
+		}
+		if _, exists := c.OperClasses[operator.Class]; operator.Class != "" && !exists {
+			return fmt.Errorf("operators[%d].class: unknown operator class %q", i, operator.Class)
+		}
+	}
+
+	return nil
+}
+
+//Apply the config to the server, loading any files it refers to. If anything
+//fails to load, the server is left unchanged.
+func (s *Server) configure(config *Config) error {
+	motd := config.MOTD
+	if config.MOTDFile != "" {
+		data, err := os.ReadFile(config.MOTDFile)
+		if err != nil {
+			return err
+		}
+		motd = string(data)
+	}
+
+	classes := buildOperClasses(config)
+	operators := make(map[string]*Operator)
+	if config.AuthFile != "" {
+		var err error
+		if operators, err = loadAuthFile(config.AuthFile, classes); err != nil {
+			return err
+		}
+	}
+	for _, operator := range config.Operators {
+		className := operator.Class
+		if className == "" {
+			className = defaultOperClass
+		}
+		class, exists := classes[className]
+		if !exists {
+			return fmt.Errorf("operator %q: unknown operator class %q", operator.Name, className)
+		}
+		operators[operator.Name] = newOperator(operator.Name, operator.Password, class)
+	}
+
+	accounts := make(map[string]*Account)
+	if config.AccountFile != "" {
+		var err error
+		if accounts, err = loadAccounts(config.AccountFile); err != nil {
+			return err
+		}
+	}
+
+	channels := make(map[string]*RegisteredChannel)
+	if config.ChannelFile != "" {
+		var err error
+		if channels, err = loadChannels(config.ChannelFile); err != nil {
+			return err
+		}
+	}
+
+	//Certificates are only needed if there's a TLS listener, either in the
+	//config or still open from before a rehash
+	needTLS := hasTLSListener(config.Listeners) || hasTLSListener(s.listeners)
+
+	var certificates []tls.Certificate
+	acmeManager := s.acmeManager
+	if len(config.TLS.ACME.Domains) == 0 {
+		acmeManager = nil
+		if needTLS {
+			var err error
+			if certificates, err = loadCertificates(&config.TLS); err != nil {
+				return err
+			}
+		}
+	} else if acmeManager == nil || !reflect.DeepEqual(s.config.Load().TLS.ACME, config.TLS.ACME) {
+		//The manager is kept across rehashes unless its config changes, as it
+		//holds the certificates it has obtained and schedules their renewal
+		var err error
+		if acmeManager, err = newACMEManager(&config.TLS.ACME); err != nil {
+			return err
+		}
+	}
+
+	s.config.Store(config)
+	s.acmeManager = acmeManager
+	s.tlsConfig.Store(config.TLS.build(certificates, acmeManager))
+	s.name = config.Name
+	s.motd = motd
+	s.operatorMap = operators
+	s.accountMap = accounts
+	s.accountFile = config.AccountFile
+	s.registeredChannelMap = channels
+	s.channelFile = config.ChannelFile
+	s.updateSASLCapability(config)
+	s.trimWhowas()
+
+	return nil
+}
+
+//Reload the config file and everything it refers to, and apply it to the
+//running server without disconnecting anybody
+func (s *Server) rehash() error {
+	config, err := loadConfig(s.configFile)
+	if err != nil {
+		return err
+	}
+
+	oldConfig := s.config.Load()
+	if err := s.configure(config); err != nil {
+		return err
+	}
+
+	if !reflect.DeepEqual(oldConfig.Listeners, config.Listeners) {
+		log.Printf("Changes to listeners take effect after a restart.")
+	}
+
+	for _, client := range s.clientMap {
+		client.updateLineLength()
+	}
+	s.refreshOpers()
+
+	return nil
+}
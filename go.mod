@@ -0,0 +1,13 @@
+module github.com/eXeC64/Rosella
+
+go 1.20
+
+require (
+	golang.org/x/crypto v0.31.0
+	gopkg.in/yaml.v3 v3.0.1
+)
+
+require (
+	golang.org/x/net v0.21.0 // indirect
+	golang.org/x/text v0.21.0 // indirect
+)
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+)
+
+//Most tokens sent in a single 005 reply
+const isupportTokensPerLine = 13
+
+//The ISUPPORT tokens describing the server to clients. Modes and limits come
+//from the mode tables and the config, so they can't fall out of date.
+func (s *Server) isupportTokens() []string {
+	limits := s.config.Load().Limits
+
+	targmax := ""
+	for _, command := range []string{"PRIVMSG", "NOTICE", "TAGMSG"} {
+		if targmax != "" {
+			targmax += ","
+		}
+		targmax += fmt.Sprintf("%s:%d", command, limits.MaxTargets)
+	}
+
+	return []string{"CASEMAPPING=ascii",
+		"CHANMODES=,,," + channelModeLetters(),
+		fmt.Sprintf("CHANNELLEN=%d", limits.ChannelLength),
+		"CHANTYPES=#",
+		"MODES=1",
+		fmt.Sprintf("MONITOR=%d", limits.MonitorLimit),
+		"NETWORK=" + s.name,
+		fmt.Sprintf("NICKLEN=%d", limits.NickLength),
+		"PREFIX=(" + statusModes() + ")" + statusPrefixes(),
+		"STATUSMSG=" + statusPrefixes(),
+		"TARGMAX=" + targmax,
+		fmt.Sprintf("USERLEN=%d", maxUsernameLength),
+		"WHOX"}
+}
+
+//Send the user the ISUPPORT tokens, as many to a line as allowed
+func (c *Client) sendISupport() {
+	tokens := c.server.isupportTokens()
+	for len(tokens) > isupportTokensPerLine {
+		c.reply(rplISupport, tokens[:isupportTokensPerLine]...)
+		tokens = tokens[isupportTokensPerLine:]
+	}
+	if len(tokens) > 0 {
+		c.reply(rplISupport, tokens...)
+	}
+}
+
+//The letters of every channel mode
+func channelModeLetters() string {
+	letters := ""
+	for _, flag := range new(ChannelMode).flags() {
+		letters += string(flag.char)
+	}
+	return letters
+}
+
+//The mode letters of every channel status, from highest to lowest
+func statusModes() string {
+	letters := ""
+	for _, flag := range new(ClientMode).flags() {
+		letters += string(flag.char)
+	}
+	return letters
+}
+
+//The nick prefixes of every channel status, from highest to lowest
+func statusPrefixes() string {
+	prefixes := ""
+	for _, flag := range new(ClientMode).flags() {
+		prefixes += string(flag.prefix)
+	}
+	return prefixes
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+)
+
+var errLineTooLong = errors.New("line too long")
+
+//Splits a stream into lines, accumulating partial lines across reads
+type lineReader struct {
+	reader     io.Reader
+	buf        []byte //Data read but not yet returned
+	start      int    //Offset into buf of the first unreturned byte
+	discarding bool   //Set while skipping the rest of an over-long line
+}
+
+func newLineReader(reader io.Reader) *lineReader {
+	return &lineReader{reader: reader, buf: make([]byte, 0, 4096)}
+}
+
+//Return the next line, without its line ending. Lines terminated by \r\n, \n
+//or a lone \r are all accepted. maxLength includes the line ending, as per
+//RFC 1459. If a line exceeds maxLength, errLineTooLong is returned once and
+//the remainder of that line is skipped. Any other error is from the
+//underlying reader, and any partial line is kept for the next call.
+func (r *lineReader) readLine(maxLength int) ([]byte, error) {
+	for {
+		pending := r.buf[r.start:]
+		if i := bytes.IndexAny(pending, "\r\n"); i > -1 {
+			line := pending[:i]
+			r.start += i + 1
+
+			if r.discarding {
+				r.discarding = false
+				continue
+			}
+			if len(line) == 0 {
+				//Blank lines, including the \n of a \r\n pair
+				continue
+			}
+			if len(line)+2 > maxLength {
+				return nil, errLineTooLong
+			}
+			return line, nil
+		}
+
+		if r.discarding {
+			r.buf = r.buf[:0]
+			r.start = 0
+		} else if len(pending)+2 > maxLength {
+			r.buf = r.buf[:0]
+			r.start = 0
+			r.discarding = true
+			return nil, errLineTooLong
+		}
+
+		//Move any partial line to the front of the buffer, and make room to read
+		if r.start > 0 {
+			r.buf = r.buf[:copy(r.buf, r.buf[r.start:])]
+			r.start = 0
+		}
+		if len(r.buf) == cap(r.buf) {
+			grown := make([]byte, len(r.buf), 2*cap(r.buf))
+			copy(grown, r.buf)
+			r.buf = grown
+		}
+
+		n, err := r.reader.Read(r.buf[len(r.buf):cap(r.buf)])
+		r.buf = r.buf[:len(r.buf)+n]
+		if err != nil {
+			return nil, err
+		}
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"io"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+//Read every line from the input, recording errLineTooLong as "<too long>"
+func readAllLines(reader io.Reader, maxLength int) ([]string, error) {
+	r := newLineReader(reader)
+	var lines []string
+	for {
+		line, err := r.readLine(maxLength)
+		if err == errLineTooLong {
+			lines = append(lines, "<too long>")
+			continue
+		}
+		if err != nil {
+			return lines, err
+		}
+		lines = append(lines, string(line))
+	}
+}
+
+func TestReadLine(t *testing.T) {
+	long := strings.Repeat("x", 100)
+
+	tests := []struct {
+		name      string
+		input     string
+		maxLength int
+		want      []string
+	}{
+		{"CRLF", "PING a\r\nPING b\r\n", 512, []string{"PING a", "PING b"}},
+		{"LF without CR", "PING a\nPING b\n", 512, []string{"PING a", "PING b"}},
+		{"lone CR", "PING a\rPING b\r", 512, []string{"PING a", "PING b"}},
+		{"blank lines", "\r\n\n\rPING a\r\n\r\n", 512, []string{"PING a"}},
+		{"partial line at EOF", "PING a\r\nPING b", 512, []string{"PING a"}},
+		{"exactly max length", "12345678\r\n", 10, []string{"12345678"}},
+		{"one over max length", "123456789\r\n", 10, []string{"<too long>"}},
+		{"oversized then valid", long + "\r\nPING ok\r\n", 20, []string{"<too long>", "PING ok"}},
+		{"oversized without ending then valid", long + long + long + "\nPING ok\n", 20, []string{"<too long>", "PING ok"}},
+		{"valid, oversized, valid", "PING a\r\n" + long + "\r\nPING b\r\n", 20, []string{"PING a", "<too long>", "PING b"}},
+	}
+
+	for _, test := range tests {
+		//Reading a byte at a time splits lines across reads at every point
+		readers := map[string]io.Reader{"whole": strings.NewReader(test.input),
+			"byte at a time": iotest.OneByteReader(strings.NewReader(test.input))}
+
+		for readerName, reader := range readers {
+			lines, err := readAllLines(reader, test.maxLength)
+			if err != io.EOF {
+				t.Errorf("%s (%s): got error %v, want EOF", test.name, readerName, err)
+			}
+			if strings.Join(lines, "|") != strings.Join(test.want, "|") {
+				t.Errorf("%s (%s): got %q, want %q", test.name, readerName, lines, test.want)
+			}
+		}
+	}
+}
+
+//Lines longer than the initial buffer are read whole
+func TestReadLongLine(t *testing.T) {
+	line := strings.Repeat("x", 10000)
+	lines, err := readAllLines(strings.NewReader(line+"\r\n"), 20000)
+	if err != io.EOF || len(lines) != 1 || lines[0] != line {
+		t.Errorf("got %d lines and error %v, want the line and EOF", len(lines), err)
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"os"
+)
+
+type listenerType int
+
+const (
+	listenerTLS       listenerType = iota //TLS over TCP, on any address
+	listenerPlaintext                     //Plaintext TCP, on loopback addresses only
+	listenerUnix                          //Plaintext on a Unix domain socket
+)
+
+var listenerTypeNames = map[string]listenerType{
+	"tls":       listenerTLS,
+	"plaintext": listenerPlaintext,
+	"unix":      listenerUnix,
+}
+
+func (t listenerType) String() string {
+	for name, value := range listenerTypeNames {
+		if value == t {
+			return name
+		}
+	}
+	return "unknown"
+}
+
+//A socket accepting connections for the server
+type Listener struct {
+	net.Listener
+	kind   listenerType
+	secure bool //Whether clients connecting through it count as secure
+}
+
+//Open the socket described by the config. TLS listeners are always secure,
+//plaintext ones only if the config says so, e.g. for a Tor onion service.
+func openListener(config ListenerConfig, server *Server) (*Listener, error) {
+	kind := listenerTypeNames[config.Type]
+
+	var socket net.Listener
+	var err error
+	switch kind {
+	case listenerTLS:
+		socket, err = tls.Listen("tcp", config.Address, server.listenerTLSConfig(config.ClientCerts))
+	case listenerPlaintext:
+		socket, err = net.Listen("tcp", config.Address)
+	case listenerUnix:
+		//A socket left behind by an unclean shutdown would stop us binding
+		if info, statErr := os.Stat(config.Address); statErr == nil && info.Mode()&os.ModeSocket != 0 {
+			os.Remove(config.Address)
+		}
+		socket, err = net.Listen("unix", config.Address)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &Listener{Listener: socket,
+		kind:   kind,
+		secure: kind == listenerTLS || config.Secure}, nil
+}
+
+//Whether any of the listeners use TLS, and so need certificates
+func hasTLSListener(listeners []ListenerConfig) bool {
+	for _, listener := range listeners {
+		if listenerTypeNames[listener.Type] == listenerTLS {
+			return true
+		}
+	}
+	return false
+}
+
+//Check a plaintext TCP address only binds to loopback, so passwords are never
+//sent in the clear over a network
+func checkLoopbackAddress(address string) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+
+	if host == "localhost" {
+		return nil
+	}
+	if ip := net.ParseIP(host); ip != nil && ip.IsLoopback() {
+		return nil
+	}
+
+	return fmt.Errorf("plaintext listeners must use a loopback address such as 127.0.0.1, got %q", host)
+}
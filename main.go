@@ -1,20 +1,16 @@
 package main
 
 import (
-	"crypto/tls"
 	"flag"
 	"log"
 	"os"
+	"os/signal"
 	"strings"
+	"syscall"
 )
 
 var (
-	tlsKeyFile  = flag.String("tls-key", "tls.key", "The private key file used for TLS")
-	tlsCertFile = flag.String("tls-cert", "tls.crt", "The certificate file used for TLS")
-	ircAddress  = flag.String("irc-address", ":6697", "The address:port to bind to and listen for clients on")
-	serverName  = flag.String("irc-servername", "rosella", "Server name displayed to clients")
-	authFile    = flag.String("irc-authfile", "", "File containing usernames and passwords of operators.")
-	motdFile    = flag.String("irc-motdfile", "", "File container motd to display to clients.")
+	configFile = flag.String("config", "", "The YAML config file to load. Defaults are used if not given.")
 )
 
 func main() {
@@ -23,98 +19,70 @@ func main() {
 
 	log.Printf("Rosella v%s Initialising.", VERSION)
 
-	//Init rosella itself
-	server := NewServer()
-	server.name = *serverName
+	if *configFile != "" {
+		log.Printf("Loading config file: %q", *configFile)
+	}
 
-	if *authFile != "" {
-		log.Printf("Loading auth file: %q", *authFile)
+	config, err := loadConfig(*configFile)
+	if err != nil {
+		log.Fatal(err)
+	}
 
-		f, err := os.Open(*authFile)
-		if err != nil {
-			log.Fatal(err)
-		}
-		data := make([]byte, 1024)
-		size, err := f.Read(data)
-		if err != nil {
-			log.Fatal(err)
-		}
-		f.Close()
-
-		lines := strings.Split(string(data[:size]), "\n")
-		for _, line := range lines {
-			if i := strings.IndexRune(line, '#'); i > -1 {
-				line = line[:i]
-			}
-			fields := strings.Fields(line)
-
-			if len(fields) == 2 {
-				server.operatorMap[fields[0]] = []byte(fields[1])
-			}
-		}
+	//Init rosella itself
+	server := NewServer()
+	server.configFile = *configFile
+	server.listeners = config.Listeners
+	if err := server.configure(config); err != nil {
+		log.Printf("Error loading configuration.")
+		log.Fatal(err)
 	}
 
-	if *motdFile != "" {
-		log.Printf("Loading motd file: %q", *motdFile)
+	if !hasTLSListener(config.Listeners) {
+		log.Printf("No TLS listeners, so no certificates are needed.")
+	} else if len(config.TLS.ACME.Domains) > 0 {
+		log.Printf("Certificates for %s will be obtained with ACME.", strings.Join(config.TLS.ACME.Domains, ", "))
+	} else {
+		log.Printf("Loaded certificate and key successfully.")
+	}
 
-		f, err := os.Open(*motdFile)
+	listeners := make([]*Listener, 0, len(config.Listeners))
+	for _, listenerConfig := range config.Listeners {
+		listener, err := openListener(listenerConfig, server)
 		if err != nil {
-			log.Fatal(err)
+			log.Printf("Could not open listener on %s.", listenerConfig.Address)
+			log.Print(err)
+			return
 		}
-		data := make([]byte, 1024)
-		size, err := f.Read(data)
-		if err != nil {
-			log.Fatal(err)
-		}
-		f.Close()
 
-		server.motd = string(data[:size])
+		log.Printf("Listening on %s (%s)", listenerConfig.Address, listener.kind)
+		listeners = append(listeners, listener)
 	}
 
-	tlsConfig := new(tls.Config)
-
-	tlsConfig.PreferServerCipherSuites = true
-	tlsConfig.CipherSuites = []uint16{
-		tls.TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA,
-		tls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA,
-		tls.TLS_ECDHE_RSA_WITH_3DES_EDE_CBC_SHA,
-		tls.TLS_RSA_WITH_AES_256_CBC_SHA,
-		tls.TLS_RSA_WITH_AES_128_CBC_SHA,
-		tls.TLS_RSA_WITH_3DES_EDE_CBC_SHA}
-
-	cert, err := tls.LoadX509KeyPair(*tlsCertFile, *tlsKeyFile)
-	if err != nil {
-		log.Printf("Error loading tls certificate and key files.")
-		log.Printf(err.Error())
-		return
+	for _, listener := range listeners {
+		go acceptConnections(server, listener)
 	}
 
-	log.Printf("Loaded certificate and key successfully.")
-
-	tlsConfig.Certificates = []tls.Certificate{cert}
-
-	//Fills out tlsConfig.NameToCertificate
-	tlsConfig.BuildNameToCertificate()
-
-	tlsListener, err := tls.Listen("tcp", *ircAddress, tlsConfig)
-	if err != nil {
-		log.Printf("Could not open tls listener.")
-		log.Printf(err.Error())
-		return
-	}
-
-	go server.Run()
+	//Reload the config on SIGHUP
+	hangups := make(chan os.Signal, 1)
+	signal.Notify(hangups, syscall.SIGHUP)
+	go func() {
+		for range hangups {
+			server.eventChan <- Event{event: rehash}
+		}
+	}()
 
-	log.Printf("Listening on %s", *ircAddress)
+	server.Run()
+}
 
+func acceptConnections(server *Server, listener *Listener) {
 	for {
-		conn, err := tlsListener.Accept()
+		conn, err := listener.Accept()
 		if err != nil {
 			log.Printf("Error accepting connection.")
-			log.Printf(err.Error())
+			log.Print(err)
 			continue
 		}
 
-		server.HandleConnection(conn)
+		server.HandleConnection(conn, listener)
 	}
 }
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"errors"
+	"sort"
+	"strings"
+)
+
+var errEmptyMessage = errors.New("empty message")
+
+//Most parameters a message may have, as per RFC 1459. Anything after the
+//fourteenth parameter is part of the last, even without a colon.
+const maxParams = 15
+
+//A single IRC protocol message, as described by RFC 1459 and extended by the
+//IRCv3 message-tags specification
+type Message struct {
+	tags    map[string]string
+	source  string
+	command string
+	params  []string
+}
+
+var tagEscaper = strings.NewReplacer(";", `\:`, " ", `\s`, `\`, `\\`, "\r", `\r`, "\n", `\n`)
+
+//Parse a single line (without its line ending) into a Message
+func parseMessage(line string) (*Message, error) {
+	msg := new(Message)
+
+	line = strings.TrimLeft(line, " ")
+
+	if strings.HasPrefix(line, "@") {
+		var rawTags string
+		rawTags, line = splitWord(line[1:])
+		msg.tags = parseTags(rawTags)
+	}
+
+	if strings.HasPrefix(line, ":") {
+		msg.source, line = splitWord(line[1:])
+	}
+
+	msg.command, line = splitWord(line)
+	if msg.command == "" {
+		return nil, errEmptyMessage
+	}
+	msg.command = strings.ToUpper(msg.command)
+
+	for line != "" {
+		if strings.HasPrefix(line, ":") || len(msg.params) == maxParams-1 {
+			//The trailing parameter runs to the end of the line, spaces and all
+			msg.params = append(msg.params, strings.TrimPrefix(line, ":"))
+			break
+		}
+
+		var param string
+		param, line = splitWord(line)
+		msg.params = append(msg.params, param)
+	}
+
+	return msg, nil
+}
+
+//Split a line into its first space-delimited word and the remainder
+func splitWord(line string) (string, string) {
+	i := strings.IndexByte(line, ' ')
+	if i < 0 {
+		return line, ""
+	}
+	return line[:i], strings.TrimLeft(line[i+1:], " ")
+}
+
+func parseTags(rawTags string) map[string]string {
+	tags := make(map[string]string)
+	for _, tag := range strings.Split(rawTags, ";") {
+		if tag == "" {
+			continue
+		}
+		key, value := tag, ""
+		if i := strings.IndexByte(tag, '='); i > -1 {
+			key, value = tag[:i], tag[i+1:]
+		}
+		tags[key] = unescapeTagValue(value)
+	}
+	return tags
+}
+
+func unescapeTagValue(value string) string {
+	if strings.IndexByte(value, '\\') < 0 {
+		return value
+	}
+
+	//Backslashes before any character without a special meaning are removed
+	var b strings.Builder
+	for i := 0; i < len(value); i++ {
+		if value[i] != '\\' {
+			b.WriteByte(value[i])
+			continue
+		}
+		i++
+		if i >= len(value) {
+			//A lone trailing backslash is dropped
+			break
+		}
+		switch value[i] {
+		case ':':
+			b.WriteByte(';')
+		case 's':
+			b.WriteByte(' ')
+		case 'r':
+			b.WriteByte('\r')
+		case 'n':
+			b.WriteByte('\n')
+		default:
+			b.WriteByte(value[i])
+		}
+	}
+	return b.String()
+}
+
+//Serialise the message into a single line, without a line ending
+func (m *Message) String() string {
+	var b strings.Builder
+
+	if len(m.tags) > 0 {
+		keys := make([]string, 0, len(m.tags))
+		for key := range m.tags {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		b.WriteByte('@')
+		for i, key := range keys {
+			if i > 0 {
+				b.WriteByte(';')
+			}
+			b.WriteString(key)
+			if value := m.tags[key]; value != "" {
+				b.WriteByte('=')
+				b.WriteString(tagEscaper.Replace(value))
+			}
+		}
+		b.WriteByte(' ')
+	}
+
+	if m.source != "" {
+		b.WriteByte(':')
+		b.WriteString(m.source)
+		b.WriteByte(' ')
+	}
+
+	b.WriteString(m.command)
+
+	for i, param := range m.params {
+		b.WriteByte(' ')
+		if i == len(m.params)-1 && needsTrailing(param) {
+			b.WriteByte(':')
+		}
+		b.WriteString(param)
+	}
+
+	return b.String()
+}
+
+//Whether a parameter can only be sent as the trailing parameter
+func needsTrailing(param string) bool {
+	return param == "" || strings.HasPrefix(param, ":") || strings.IndexByte(param, ' ') > -1
+}
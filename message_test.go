@@ -0,0 +1,100 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseMessage(t *testing.T) {
+	tests := []struct {
+		line string
+		want Message
+	}{
+		{"PING token", Message{command: "PING", params: []string{"token"}}},
+		{"privmsg #chan :hi", Message{command: "PRIVMSG", params: []string{"#chan", "hi"}}},
+		{":nick!user@host NICK other", Message{source: "nick!user@host", command: "NICK", params: []string{"other"}}},
+		{"  PING   a   b", Message{command: "PING", params: []string{"a", "b"}}},
+
+		//Trailing parameters
+		{"PRIVMSG #chan ::-)", Message{command: "PRIVMSG", params: []string{"#chan", ":-)"}}},
+		{"PRIVMSG #chan :  spaced  out ", Message{command: "PRIVMSG", params: []string{"#chan", "  spaced  out "}}},
+		{"PRIVMSG #chan :", Message{command: "PRIVMSG", params: []string{"#chan", ""}}},
+		{"TOPIC #chan :a:b", Message{command: "TOPIC", params: []string{"#chan", "a:b"}}},
+
+		//Tags
+		{"@a=1;b;c= TAGMSG #chan", Message{tags: map[string]string{"a": "1", "b": "", "c": ""}, command: "TAGMSG", params: []string{"#chan"}}},
+		{`@+x=semi\:space\sslash\\cr\rlf\n TAGMSG #chan`, Message{tags: map[string]string{"+x": "semi;space slash\\cr\rlf\n"}, command: "TAGMSG", params: []string{"#chan"}}},
+		{`@+x=\b\ TAGMSG #chan`, Message{tags: map[string]string{"+x": "b"}, command: "TAGMSG", params: []string{"#chan"}}},
+		{"@+x=1 :src PRIVMSG #chan :hi", Message{tags: map[string]string{"+x": "1"}, source: "src", command: "PRIVMSG", params: []string{"#chan", "hi"}}},
+
+		//Anything after the fourteenth parameter is part of the fifteenth
+		{"CMD 1 2 3 4 5 6 7 8 9 10 11 12 13 14 15 16 :17", Message{command: "CMD",
+			params: []string{"1", "2", "3", "4", "5", "6", "7", "8", "9", "10", "11", "12", "13", "14", "15 16 :17"}}},
+		{"CMD 1 2 3 4 5 6 7 8 9 10 11 12 13 14 :15 16", Message{command: "CMD",
+			params: []string{"1", "2", "3", "4", "5", "6", "7", "8", "9", "10", "11", "12", "13", "14", "15 16"}}},
+	}
+
+	for _, test := range tests {
+		msg, err := parseMessage(test.line)
+		if err != nil {
+			t.Errorf("parseMessage(%q): unexpected error %s", test.line, err)
+			continue
+		}
+		if !reflect.DeepEqual(*msg, test.want) {
+			t.Errorf("parseMessage(%q) = %#v, want %#v", test.line, *msg, test.want)
+		}
+	}
+}
+
+func TestParseEmptyMessage(t *testing.T) {
+	for _, line := range []string{"", "   ", "@a=1", ":source", "@a=1 :source "} {
+		if _, err := parseMessage(line); err != errEmptyMessage {
+			t.Errorf("parseMessage(%q): got error %v, want %v", line, err, errEmptyMessage)
+		}
+	}
+}
+
+func TestMessageString(t *testing.T) {
+	tests := []struct {
+		msg  Message
+		want string
+	}{
+		{Message{command: "PING", params: []string{"token"}}, "PING token"},
+		{Message{source: "nick", command: "PRIVMSG", params: []string{"#chan", "hello world"}}, ":nick PRIVMSG #chan :hello world"},
+		{Message{command: "PRIVMSG", params: []string{"#chan", ":-)"}}, "PRIVMSG #chan ::-)"},
+		{Message{command: "PRIVMSG", params: []string{"#chan", ""}}, "PRIVMSG #chan :"},
+		{Message{command: "PRIVMSG", params: []string{"#chan", " leading"}}, "PRIVMSG #chan : leading"},
+		{Message{tags: map[string]string{"b": "", "a": "x y;z\\\r\n"}, command: "TAGMSG", params: []string{"#chan"}}, `@a=x\sy\:z\\\r\n;b TAGMSG #chan`},
+	}
+
+	for _, test := range tests {
+		if got := test.msg.String(); got != test.want {
+			t.Errorf("%#v.String() = %q, want %q", test.msg, got, test.want)
+		}
+	}
+}
+
+//Serialising a parsed message gives back the same message
+func TestMessageRoundTrip(t *testing.T) {
+	messages := []Message{
+		{command: "PRIVMSG", params: []string{"#chan", "hi"}},
+		{source: "nick", command: "PRIVMSG", params: []string{"#chan", "  spaced  out "}},
+		{command: "PRIVMSG", params: []string{"#chan", ":starts with a colon"}},
+		{command: "PRIVMSG", params: []string{"#chan", ""}},
+		{tags: map[string]string{"+x": "semi;space slash\\cr\rlf\n", "+empty": ""}, command: "TAGMSG", params: []string{"#chan"}},
+		{command: "CMD", params: strings.Fields("1 2 3 4 5 6 7 8 9 10 11 12 13 14 15")},
+	}
+
+	for _, msg := range messages {
+		line := msg.String()
+		parsed, err := parseMessage(line)
+		if err != nil {
+			t.Errorf("parseMessage(%q): unexpected error %s", line, err)
+			continue
+		}
+		if !reflect.DeepEqual(*parsed, msg) {
+			t.Errorf("parseMessage(%q) = %#v, want %#v", line, *parsed, msg)
+		}
+	}
+}
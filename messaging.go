@@ -0,0 +1,103 @@
+package main
+
+import (
+	"strings"
+	"time"
+)
+
+//Relay a PRIVMSG, NOTICE or TAGMSG to each of its comma separated targets.
+//Nothing may be sent in response to a NOTICE, so errors are only reported for
+//the other commands.
+func (s *Server) relayMessage(client *Client, command, targets string, tags map[string]string, message string) {
+	quiet := command == "NOTICE"
+
+	//Tags alone, such as typing notifications, don't end the user's idle time
+	if command != "TAGMSG" {
+		client.lastMessage = time.Now()
+	}
+
+	targetList := strings.Split(targets, ",")
+	if len(targetList) > s.config.Load().Limits.MaxTargets {
+		if !quiet {
+			client.reply(errTooManyTargets, targets)
+		}
+		return
+	}
+
+	for _, target := range targetList {
+		if target == "" {
+			continue
+		}
+
+		if command == "PRIVMSG" {
+			if strings.ToLower(target) == strings.ToLower(nickServ) {
+				s.handleNickServ(client, strings.Fields(message))
+				continue
+			}
+			if strings.ToLower(target) == strings.ToLower(chanServ) {
+				s.handleChanServ(client, strings.Fields(message))
+				continue
+			}
+		}
+
+		status, channelName := splitStatusPrefix(target)
+
+		channel, chanExists := s.channelMap[strings.ToLower(channelName)]
+		client2, clientExists := s.clientMap[strings.ToLower(target)]
+
+		if chanExists {
+			if !channel.canSpeak(client) {
+				if !quiet {
+					client.reply(errCannotSend, target)
+				}
+				continue
+			}
+			for _, c := range channel.clientMap {
+				if c != client && channel.hasStatus(c, status) {
+					c.relay(command, tags, client.nick, target, message)
+				}
+			}
+		} else if clientExists {
+			client2.relay(command, tags, client.nick, client2.nick, message)
+			if command == "PRIVMSG" && client2.away != "" {
+				client.reply(rplAway, client2.nick, client2.away)
+			}
+		} else if !quiet {
+			client.reply(errNoSuchNick, target)
+		}
+	}
+}
+
+//Send the user a message from somebody else
+func (c *Client) relay(command string, tags map[string]string, source, target, message string) {
+	switch command {
+	case "PRIVMSG":
+		c.replyWithTags(tags, rplMsg, source, target, message)
+	case "NOTICE":
+		c.replyWithTags(tags, rplNotice, source, target, message)
+	case "TAGMSG":
+		//Without message-tags there's nothing to show them
+		if c.capMap["message-tags"] {
+			c.replyWithTags(tags, rplTagMsg, source, target)
+		}
+	}
+}
+
+//Split a target such as "@#channel" into its status prefix and channel name.
+//Targets without a prefix have an empty status.
+func splitStatusPrefix(target string) (string, string) {
+	if len(target) > 1 && strings.IndexByte(statusPrefixes(), target[0]) > -1 && channelRegexp.MatchString(target[1:]) {
+		return target[:1], target[1:]
+	}
+	return "", target
+}
+
+//Check whether the user has at least the status given by a STATUSMSG prefix
+//in the channel. Everybody has the empty status.
+func (channel *Channel) hasStatus(c *Client, status string) bool {
+	if status == "" {
+		return true
+	}
+	mode, inChannel := channel.modeMap[c.key]
+	return inChannel && mode.hasStatus(rune(status[0]))
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/bcrypt"
+	"os"
+	"sort"
+	"strings"
+)
+
+type operPrivilege int
+
+const (
+	privKill      operPrivilege = iota //May KILL users
+	privRehash                         //May REHASH the server
+	privSeeSecret                      //May see secret channels they aren't in
+	privOverride                       //May override channel modes, topic locks and KICK
+)
+
+//The class of operators in the auth file that don't name one
+const defaultOperClass = "admin"
+
+var operPrivilegeNames = map[string]operPrivilege{
+	"kill":       privKill,
+	"rehash":     privRehash,
+	"see-secret": privSeeSecret,
+	"override":   privOverride,
+}
+
+//Every operator belongs to a class, which decides what they may do
+type OperClass struct {
+	name       string
+	privileges map[operPrivilege]bool
+}
+
+type Operator struct {
+	name     string
+	password []byte //bcrypt hashed password, nil if identified by certificate
+	certfp   string //Fingerprint of the operator's client certificate
+	class    *OperClass
+}
+
+//Prefix of an operator's password field that gives a certificate fingerprint
+//instead of a bcrypt hash
+const certfpPrefix = "certfp:"
+
+//Check an operator's password is either a bcrypt hash or certfp: and a
+//SHA-256 fingerprint, as anything else could never match
+func checkOperatorPassword(password string) error {
+	if strings.HasPrefix(password, certfpPrefix) {
+		fp, err := hex.DecodeString(normalizeFingerprint(password[len(certfpPrefix):]))
+		if err != nil || len(fp) != sha256.Size {
+			return errors.New("must be certfp: and a SHA-256 certificate fingerprint")
+		}
+		return nil
+	}
+	if _, err := bcrypt.Cost([]byte(password)); err != nil {
+		return errors.New("must be a bcrypt hash, or certfp: and a certificate fingerprint")
+	}
+	return nil
+}
+
+func newOperator(name, password string, class *OperClass) *Operator {
+	if strings.HasPrefix(password, certfpPrefix) {
+		return &Operator{name: name, certfp: normalizeFingerprint(password[len(certfpPrefix):]), class: class}
+	}
+	return &Operator{name: name, password: []byte(password), class: class}
+}
+
+//Check the user may OPER as the operator, by their client certificate or
+//their password, then call done with the result
+func (o *Operator) authenticate(c *Client, password string, done func(matched bool)) {
+	if o.certfp != "" {
+		done(c.certfp == o.certfp)
+		return
+	}
+	c.checkPassword(o.password, password, done)
+}
+
+//Check whether the user is an operator with the given privilege
+func (c *Client) hasPrivilege(privilege operPrivilege) bool {
+	return c.operClass != nil && c.operClass.privileges[privilege]
+}
+
+//Give every operator the class their operator now has after a rehash, as the
+//old classes may have changed. Anybody whose operator has been removed is no
+//longer an operator.
+func (s *Server) refreshOpers() {
+	for _, client := range s.clientMap {
+		if client.operClass == nil {
+			continue
+		}
+
+		operator, exists := s.operatorMap[client.operName]
+		if !exists {
+			client.operClass = nil
+			client.operName = ""
+			client.reply(rplUMode, client.nick, "-o")
+			client.reply(rplNotice, s.name, client.nick, "Your operator account has been removed, so you are no longer an operator")
+			continue
+		}
+
+		if operator.class.name != client.operClass.name {
+			client.reply(rplNotice, s.name, client.nick, "Your operator class is now "+operator.class.name)
+		}
+		client.operClass = operator.class
+	}
+}
+
+//Send a server notice to every operator
+func (s *Server) noticeOpers(text string) {
+	for _, client := range s.clientMap {
+		if client.operClass != nil {
+			client.reply(rplNotice, s.name, client.nick, text)
+		}
+	}
+}
+
+//Build the operator classes from the config
+func buildOperClasses(config *Config) map[string]*OperClass {
+	classes := make(map[string]*OperClass, len(config.OperClasses))
+	for name, privilegeNames := range config.OperClasses {
+		class := &OperClass{name: name, privileges: make(map[operPrivilege]bool)}
+		for _, privilegeName := range privilegeNames {
+			class.privileges[operPrivilegeNames[privilegeName]] = true
+		}
+		classes[name] = class
+	}
+	return classes
+}
+
+//Load the operators from an auth file. Each line holds a username, a bcrypt
+//hashed password or certfp: and a certificate fingerprint, and optionally the
+//name of an operator class, separated by spaces. Operators without a class
+//are in the default class. Anything after a # is a comment. Every
+//malformed line is reported, not just the first.
+func loadAuthFile(path string, classes map[string]*OperClass) (map[string]*Operator, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	operators := make(map[string]*Operator)
+	var lineErrors []string
+
+	scanner := bufio.NewScanner(f)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := scanner.Text()
+		if i := strings.IndexRune(line, '#'); i > -1 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+
+		if len(fields) < 2 || len(fields) > 3 {
+			lineErrors = append(lineErrors, fmt.Sprintf("%s:%d: expected a username, password and optional class", path, lineNum))
+			continue
+		}
+
+		className := defaultOperClass
+		if len(fields) == 3 {
+			className = fields[2]
+		}
+		class, exists := classes[className]
+		if !exists {
+			lineErrors = append(lineErrors, fmt.Sprintf("%s:%d: unknown operator class %q", path, lineNum, className))
+			continue
+		}
+
+		if err := checkOperatorPassword(fields[1]); err != nil {
+			lineErrors = append(lineErrors, fmt.Sprintf("%s:%d: password %s", path, lineNum, err))
+			continue
+		}
+
+		if _, exists := operators[fields[0]]; exists {
+			lineErrors = append(lineErrors, fmt.Sprintf("%s:%d: duplicate operator %q", path, lineNum, fields[0]))
+			continue
+		}
+
+		operators[fields[0]] = newOperator(fields[0], fields[1], class)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+
+	if len(lineErrors) > 0 {
+		return nil, errors.New(strings.Join(lineErrors, "\n"))
+	}
+
+	return operators, nil
+}
+
+//The names of every privilege, for error messages
+func operPrivilegeList() string {
+	names := make([]string, 0, len(operPrivilegeNames))
+	for name := range operPrivilegeNames {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+)
+
+//Longest list of nicks sent in a single MONITOR reply, so the line stays
+//within 512 bytes
+const monitorListLength = 400
+
+//Handle ISON, replying with whichever of the given nicks are online
+func (s *Server) handleIson(client *Client, args []string) {
+	nicks := strings.Fields(strings.Join(args, " "))
+	if len(nicks) == 0 {
+		client.reply(errMoreArgs)
+		return
+	}
+
+	online := make([]string, 0, len(nicks))
+	for _, nick := range nicks {
+		if target, exists := s.clientMap[strings.ToLower(nick)]; exists && target.registered {
+			online = append(online, target.nick)
+		}
+	}
+	client.reply(rplIsOn, strings.Join(online, " "))
+}
+
+//Most nicks a single USERHOST may ask about
+const maxUserhostNicks = 5
+
+//Handle USERHOST, replying with the username of each of the given nicks that
+//are online, and whether they're operators or away. Hosts are always hidden.
+func (s *Server) handleUserhost(client *Client, args []string) {
+	nicks := strings.Fields(strings.Join(args, " "))
+	if len(nicks) == 0 {
+		client.reply(errMoreArgs)
+		return
+	}
+	if len(nicks) > maxUserhostNicks {
+		nicks = nicks[:maxUserhostNicks]
+	}
+
+	replies := make([]string, 0, len(nicks))
+	for _, nick := range nicks {
+		target, exists := s.clientMap[strings.ToLower(nick)]
+		if !exists || !target.registered {
+			continue
+		}
+
+		reply := target.nick
+		if target.operClass != nil {
+			reply += "*"
+		}
+		if target.away != "" {
+			reply += "=-"
+		} else {
+			reply += "=+"
+		}
+		replies = append(replies, reply+target.username+"@"+hiddenHost)
+	}
+	client.reply(rplUserhost, strings.Join(replies, " "))
+}
+
+//Handle MONITOR, which adds nicks to or removes them from the user's monitor
+//list (+ and -), clears it (C), lists it (L) or shows which of its nicks are
+//online (S). The user is told whenever a monitored nick comes online or goes
+//offline.
+func (s *Server) handleMonitor(client *Client, args []string) {
+	if len(args) < 1 {
+		client.reply(errMoreArgs)
+		return
+	}
+
+	switch strings.ToUpper(args[0]) {
+	case "+":
+		if len(args) < 2 {
+			client.reply(errMoreArgs)
+			return
+		}
+
+		limit := s.config.Load().Limits.MonitorLimit
+		var added []string
+		for i, nick := range strings.Split(args[1], ",") {
+			if nick == "" {
+				continue
+			}
+			key := strings.ToLower(nick)
+			if _, exists := client.monitorMap[key]; exists {
+				continue
+			}
+			if len(client.monitorMap) >= limit {
+				client.reply(errMonListFull, strconv.Itoa(limit), strings.Join(strings.Split(args[1], ",")[i:], ","))
+				break
+			}
+
+			client.monitorMap[key] = nick
+			if s.monitorMap[key] == nil {
+				s.monitorMap[key] = make(map[*Client]struct{})
+			}
+			s.monitorMap[key][client] = struct{}{}
+			added = append(added, nick)
+		}
+		client.sendMonitorStatus(added)
+
+	case "-":
+		if len(args) < 2 {
+			client.reply(errMoreArgs)
+			return
+		}
+
+		for _, nick := range strings.Split(args[1], ",") {
+			client.unmonitor(strings.ToLower(nick))
+		}
+
+	case "C":
+		for key := range client.monitorMap {
+			client.unmonitor(key)
+		}
+
+	case "L":
+		nicks := make([]string, 0, len(client.monitorMap))
+		for _, nick := range client.monitorMap {
+			nicks = append(nicks, nick)
+		}
+		client.replyList(rplMonList, nicks)
+		client.reply(rplEndOfMonList)
+
+	case "S":
+		nicks := make([]string, 0, len(client.monitorMap))
+		for _, nick := range client.monitorMap {
+			nicks = append(nicks, nick)
+		}
+		client.sendMonitorStatus(nicks)
+	}
+}
+
+//Tell the user which of the nicks are online and which are offline
+func (c *Client) sendMonitorStatus(nicks []string) {
+	var online, offline []string
+	for _, nick := range nicks {
+		if target, exists := c.server.clientMap[strings.ToLower(nick)]; exists && target.registered {
+			online = append(online, target.hostmask())
+		} else {
+			offline = append(offline, nick)
+		}
+	}
+	c.replyList(rplMonOnline, online)
+	c.replyList(rplMonOffline, offline)
+}
+
+//Stop monitoring a nick, given in lowercase
+func (c *Client) unmonitor(key string) {
+	delete(c.monitorMap, key)
+	if watchers, exists := c.server.monitorMap[key]; exists {
+		delete(watchers, c)
+		if len(watchers) == 0 {
+			delete(c.server.monitorMap, key)
+		}
+	}
+}
+
+//Tell everybody monitoring the user's nick that it has come online
+func (s *Server) monitorOnline(c *Client) {
+	for watcher := range s.monitorMap[c.key] {
+		watcher.reply(rplMonOnline, c.hostmask())
+	}
+}
+
+//Tell everybody monitoring a nick that it has gone offline
+func (s *Server) monitorOffline(nick string) {
+	for watcher := range s.monitorMap[strings.ToLower(nick)] {
+		watcher.reply(rplMonOffline, nick)
+	}
+}
+
+//Send the user a reply listing the items, split over as many lines as needed.
+//Nothing is sent for an empty list.
+func (c *Client) replyList(code replyCode, items []string) {
+	list := ""
+	for _, item := range items {
+		if list != "" && len(list)+1+len(item) > monitorListLength {
+			c.reply(code, list)
+			list = ""
+		}
+		if list != "" {
+			list += ","
+		}
+		list += item
+	}
+	if list != "" {
+		c.reply(code, list)
+	}
+}
+
+//The user's nick, username and hidden host, as nick!user@host. Either may
+//still be * during registration.
+func (c *Client) hostmask() string {
+	username := c.username
+	if username == "" {
+		username = "*"
+	}
+	return c.target() + "!" + username + "@" + hiddenHost
+}
@@ -1,19 +1,45 @@
 package main
 
-import "net"
+import (
+	"crypto/tls"
+	"golang.org/x/crypto/acme/autocert"
+	"net"
+	"sync/atomic"
+	"time"
+)
 
 const (
 	VERSION = "1.2.0"
 )
 
 type Server struct {
-	eventChan   chan Event
-	running     bool
-	name        string
-	clientMap   map[string]*Client  //Map of nicks → clients
-	channelMap  map[string]*Channel //Map of channel names → channels
-	operatorMap map[string][]byte   //Map of usernames → bcrypt hashed passwords
-	motd        string
+	eventChan     chan Event
+	running       bool
+	name          string
+	clientMap     map[string]*Client   //Map of nicks → clients
+	channelMap    map[string]*Channel  //Map of channel names → channels
+	operatorMap   map[string]*Operator //Map of usernames → operators
+	capabilityMap map[string]string    //Map of capability names → values
+	accountMap    map[string]*Account  //Map of account names → accounts
+	accountFile   string               //File accounts are saved to, if registration is enabled
+
+	registeredChannelMap map[string]*RegisteredChannel //Map of channel names → registrations
+	channelFile          string                        //File registered channels are saved to
+	motd                 string
+	config               atomic.Pointer[Config] //Read by connection goroutines, replaced on rehash
+	configFile           string
+	listeners            []ListenerConfig           //Listeners opened at startup, which last until a restart
+	created              time.Time                  //When the server started, for RPL_CREATED
+	maxUsers             int                        //Most users registered at once, for LUSERS
+	tlsConfig            atomic.Pointer[tls.Config] //Used for every TLS handshake, replaced on rehash
+	acmeManager          *autocert.Manager          //Obtains certificates, if ACME is enabled
+	whowas               []WhowasEntry              //Nicks recently given up, oldest first
+
+	monitorMap map[string]map[*Client]struct{} //Map of nicks → clients monitoring them
+
+	//Limits how many passwords are checked at once, so bcrypt can't take all
+	//the CPU away from the server goroutine
+	passwordSlots chan struct{}
 }
 
 type Client struct {
@@ -23,10 +49,49 @@ type Client struct {
 	outputChan chan string
 	nick       string
 	key        string
+	realname   string
 	registered bool
 	connected  bool
-	operator   bool
+	operClass  *OperClass //Set once the user has used OPER
+	operName   string     //Name of the operator the user OPERed as
 	channelMap map[string]*Channel
+
+	listener listenerType //Type of listener the client connected through
+	secure   bool         //Connected over TLS, or through a listener trusted to be secure
+	certfp   string       //SHA-256 fingerprint of the client's TLS certificate, if it sent one
+
+	capMap         map[string]bool //Set of negotiated capabilities
+	capVersion     int             //Highest CAP LS version the client has sent
+	capNegotiating bool            //Registration is held until CAP END
+
+	username string //Sent with USER
+	password string //Sent with PASS, checked when registration completes
+
+	passwordAccepted bool //The connection password was checked and is right
+	checkingPassword bool //A password is being checked, see checkPassword
+	failedPasswords  int  //Wrong passwords sent so far
+
+	//Fires if the client doesn't register in time
+	registrationTimer *time.Timer
+
+	lastActive  time.Time //When the client last sent anything
+	pingSent    time.Time //When we pinged the client, zero if it has answered since
+	signon      time.Time //When the client registered
+	lastMessage time.Time //When the user last sent a message, for idle times
+
+	away       string            //Away message, empty if the user isn't away
+	monitorMap map[string]string //Map of monitored nicks, lowercased → as given
+
+	account       string //Name of the account the user is logged in to
+	saslMechanism string //SASL mechanism of the exchange in progress
+	saslBuffer    string //Base64 payload received so far
+
+	//Fires if the user doesn't identify for their registered nick in time
+	nickTimer *time.Timer
+
+	//Maximum length of a line the client may send. Only accessed atomically, as
+	//it is read by readThread.
+	maxLineLength int32
 }
 
 type eventType int
@@ -35,12 +100,19 @@ const (
 	connected eventType = iota
 	disconnected
 	command
+	inputTooLong
+	nickTimeout
+	rehash
+	registrationTimeout
+	pingCheck
+	passwordChecked
 )
 
 type Event struct {
-	client *Client
-	input  string
-	event  eventType
+	client   *Client
+	input    string
+	event    eventType
+	callback func() //Run on the server goroutine, for passwordChecked
 }
 
 type Channel struct {
@@ -56,51 +128,132 @@ type ChannelMode struct {
 	topicLocked bool //Only ops may change topic
 	moderated   bool //Only ops and voiced may speak
 	noExternal  bool //Only users in the channel may talk to it
+	secureOnly  bool //Only secure clients may join
+}
+
+//A mode flag and the letter that sets it
+type modeFlag struct {
+	char  rune
+	value *bool
+}
+
+//Every channel mode, in the order they're displayed. MODE, ChanServ and
+//ISUPPORT all work from this list, so a new mode only needs adding here.
+func (m *ChannelMode) flags() []modeFlag {
+	return []modeFlag{{'s', &m.secret},
+		{'t', &m.topicLocked},
+		{'m', &m.moderated},
+		{'n', &m.noExternal},
+		{'Z', &m.secureOnly}}
 }
 
 func (m *ChannelMode) String() string {
 	modeStr := ""
-	if m.secret {
-		modeStr += "s"
-	}
-	if m.topicLocked {
-		modeStr += "t"
-	}
-	if m.moderated {
-		modeStr += "m"
-	}
-	if m.noExternal {
-		modeStr += "n"
+	for _, flag := range m.flags() {
+		if *flag.value {
+			modeStr += string(flag.char)
+		}
 	}
 	return modeStr
 }
 
+//Apply a mode string such as "+tn-s" to the channel's modes
+func (m *ChannelMode) apply(modes string) {
+	applyModes(m.flags(), modes)
+}
+
 type ClientMode struct {
 	operator bool //Channel operator
 	voice    bool //Has voice
 }
 
+//A channel status, the mode letter that gives it and the prefix shown before
+//the nick of users that have it
+type statusFlag struct {
+	modeFlag
+	prefix rune
+}
+
+//Every channel status, from highest to lowest. NAMES, MODE, STATUSMSG and
+//ISUPPORT all work from this list, so a new status only needs adding here.
+func (m *ClientMode) flags() []statusFlag {
+	return []statusFlag{{modeFlag{'o', &m.operator}, '@'},
+		{modeFlag{'v', &m.voice}, '+'}}
+}
+
+//The prefix of the user's highest status
 func (m *ClientMode) Prefix() string {
-	if m.operator {
-		return "@"
-	} else if m.voice {
-		return "+"
-	} else {
-		return ""
+	for _, flag := range m.flags() {
+		if *flag.value {
+			return string(flag.prefix)
+		}
+	}
+	return ""
+}
+
+//The prefixes of every status the user has, from highest to lowest
+func (m *ClientMode) Prefixes() string {
+	prefixes := ""
+	for _, flag := range m.flags() {
+		if *flag.value {
+			prefixes += string(flag.prefix)
+		}
 	}
+	return prefixes
 }
 
 func (m *ClientMode) String() string {
 	modeStr := ""
-	if m.operator {
-		modeStr += "o"
-	}
-	if m.voice {
-		modeStr += "v"
+	for _, flag := range m.flags() {
+		if *flag.value {
+			modeStr += string(flag.char)
+		}
 	}
 	return modeStr
 }
 
+//Apply a mode string such as "+o-v" to the client's modes
+func (m *ClientMode) apply(modes string) {
+	flags := m.flags()
+	modeFlags := make([]modeFlag, len(flags))
+	for i, flag := range flags {
+		modeFlags[i] = flag.modeFlag
+	}
+	applyModes(modeFlags, modes)
+}
+
+//Check whether the user has the status given by the prefix, or a higher one
+func (m *ClientMode) hasStatus(prefix rune) bool {
+	for _, flag := range m.flags() {
+		if *flag.value {
+			return true
+		}
+		if flag.prefix == prefix {
+			return false
+		}
+	}
+	return false
+}
+
+//Set or unset the flags named in a mode string. Unknown letters are ignored.
+func applyModes(flags []modeFlag, modes string) {
+	set := true
+	for _, char := range modes {
+		switch char {
+		case '+':
+			set = true
+		case '-':
+			set = false
+		default:
+			for _, flag := range flags {
+				if flag.char == char {
+					*flag.value = set
+				}
+			}
+		}
+	}
+}
+
 type signalCode int
 
 const (
@@ -142,4 +295,71 @@ const (
 	errPassword
 	errNoPriv
 	errCannotSend
+	errInputTooLong
+	rplCap
+	rplCapMore
+	errInvalidCapCmd
+	rplTagMsg
+	rplAuthenticate
+	rplLoggedIn
+	rplSASLSuccess
+	errSASLFail
+	errSASLTooLong
+	errSASLAborted
+	errSASLAlready
+	rplSASLMechs
+	rplNotice
+	rplAccount
+	rplMode
+	rplRehashing
+	errSecureOnly
+	errTooManyTargets
+	rplISupport
+	rplYourHost
+	rplCreated
+	rplMyInfo
+	rplLuserClient
+	rplLuserOp
+	rplLuserUnknown
+	rplLuserChannels
+	rplLuserMe
+	rplLocalUsers
+	rplGlobalUsers
+	errNoMOTD
+	rplUModeIs
+	rplUMode
+	errUsersDontMatch
+	errInvalidUsername
+	rplError
+	rplPing
+	errNoOrigin
+	rplQuit
+	rplWhoReply
+	rplWhoxReply
+	rplEndOfWho
+	rplWhoisUser
+	rplWhoisChannels
+	rplWhoisServer
+	rplWhoisOperator
+	rplWhoisAccount
+	rplWhoisSecure
+	rplWhoisCertfp
+	rplWhoisListener
+	rplWhoisIdle
+	rplEndOfWhois
+	rplWhowasUser
+	rplWhowasServer
+	rplEndOfWhowas
+	errWasNoSuchNick
+	rplAway
+	rplUnAway
+	rplNowAway
+	rplAwayNotify
+	rplIsOn
+	rplUserhost
+	rplMonOnline
+	rplMonOffline
+	rplMonList
+	rplEndOfMonList
+	errMonListFull
 )
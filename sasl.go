@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"strings"
+)
+
+const (
+	//SASL payloads are sent in chunks of at most this many bytes
+	saslChunkLength = 400
+
+	//The largest decoded SASL payload we're willing to buffer
+	saslMaxLength = 8192
+)
+
+//The SASL mechanisms the config makes usable, comma separated, or an empty
+//string if there are none. Accounts only come from the account file, and
+//EXTERNAL also needs a listener asking for client certificates.
+func saslMechanisms(config *Config, listeners []ListenerConfig) string {
+	if config.AccountFile == "" {
+		return ""
+	}
+
+	for _, listener := range listeners {
+		if listenerTypeNames[listener.Type] == listenerTLS && listener.ClientCerts {
+			return "PLAIN,EXTERNAL"
+		}
+	}
+	return "PLAIN"
+}
+
+//Offer the sasl capability with the mechanisms the config makes usable, or
+//withdraw it if there are none. Clients with cap-notify hear about changes.
+func (s *Server) updateSASLCapability(config *Config) {
+	if mechanisms := saslMechanisms(config, s.listeners); mechanisms != "" {
+		s.addCapability("sasl", mechanisms)
+	} else {
+		s.removeCapability("sasl")
+	}
+}
+
+//Handle an AUTHENTICATE command from a client
+func (s *Server) handleAuthenticate(client *Client, args []string) {
+	if client.capMap["sasl"] == false {
+		client.reply(errSASLFail)
+		return
+	}
+
+	if client.account != "" {
+		client.reply(errSASLAlready)
+		return
+	}
+
+	if len(args) < 1 {
+		client.reply(errMoreArgs)
+		return
+	}
+
+	if args[0] == "*" {
+		client.resetSASL()
+		client.reply(errSASLAborted)
+		return
+	}
+
+	if client.saslMechanism == "" {
+		mechanism := strings.ToUpper(args[0])
+		mechanisms := s.capabilityMap["sasl"]
+		if !strings.Contains(","+mechanisms+",", ","+mechanism+",") {
+			client.reply(rplSASLMechs, mechanisms)
+			client.reply(errSASLFail)
+			return
+		}
+
+		client.saslMechanism = mechanism
+		client.reply(rplAuthenticate, "+")
+		return
+	}
+
+	chunk := args[0]
+	if len(chunk) > saslChunkLength || len(client.saslBuffer)+len(chunk) > saslMaxLength {
+		client.resetSASL()
+		client.reply(errSASLTooLong)
+		return
+	}
+
+	if chunk != "+" {
+		client.saslBuffer += chunk
+	}
+	if len(chunk) == saslChunkLength {
+		//There's more to come
+		return
+	}
+
+	payload, err := base64.StdEncoding.DecodeString(client.saslBuffer)
+	mechanism := client.saslMechanism
+	client.resetSASL()
+	if err != nil {
+		client.reply(errSASLFail)
+		return
+	}
+
+	switch mechanism {
+	case "PLAIN":
+		s.authenticatePlain(client, payload)
+	case "EXTERNAL":
+		client.finishSASL(s.authenticateExternal(client, payload))
+	}
+}
+
+//Tell the client whether its SASL exchange succeeded, logging it in to the
+//account if it did. A nil account means it failed.
+func (c *Client) finishSASL(account *Account) {
+	if account == nil {
+		c.reply(errSASLFail)
+		return
+	}
+
+	c.setAccount(account.name)
+	c.reply(rplSASLSuccess)
+}
+
+//Check a SASL PLAIN payload of authzid\0authcid\0password, then finish the
+//exchange once the password has been checked
+func (s *Server) authenticatePlain(client *Client, payload []byte) {
+	fields := bytes.Split(payload, []byte{0})
+	if len(fields) != 3 {
+		client.finishSASL(nil)
+		return
+	}
+
+	authzid, authcid, password := string(fields[0]), string(fields[1]), string(fields[2])
+	if authzid != "" && strings.ToLower(authzid) != strings.ToLower(authcid) {
+		//Logging in as somebody else isn't supported
+		client.finishSASL(nil)
+		return
+	}
+
+	//Unknown accounts have no password, so they count as failed attempts too
+	var hash []byte
+	account, exists := s.accountMap[strings.ToLower(authcid)]
+	if exists {
+		hash = account.password
+	}
+
+	client.checkPassword(hash, password, func(matched bool) {
+		if !matched {
+			client.finishSASL(nil)
+			return
+		}
+		client.finishSASL(account)
+	})
+}
+
+//Check the client's TLS certificate, optionally against the account named in
+//the SASL EXTERNAL payload
+func (s *Server) authenticateExternal(client *Client, payload []byte) *Account {
+	fp := client.certfp
+	if fp == "" {
+		return nil
+	}
+
+	if authzid := string(payload); authzid != "" {
+		if account, exists := s.accountMap[strings.ToLower(authzid)]; exists && account.hasCertFP(fp) {
+			return account
+		}
+		return nil
+	}
+
+	for _, account := range s.accountMap {
+		if account.hasCertFP(fp) {
+			return account
+		}
+	}
+
+	return nil
+}
+
+//Abort any SASL exchange in progress
+func (c *Client) abortSASL() {
+	if c.saslMechanism != "" {
+		c.resetSASL()
+		c.reply(errSASLAborted)
+	}
+}
+
+func (c *Client) resetSASL() {
+	c.saslMechanism = ""
+	c.saslBuffer = ""
+}
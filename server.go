@@ -2,40 +2,74 @@ package main
 
 import (
 	"fmt"
-	"golang.org/x/crypto/bcrypt"
 	"log"
 	"net"
 	"regexp"
+	"runtime"
+	"strconv"
 	"strings"
+	"time"
 )
 
 var (
 	nickRegexp    = regexp.MustCompile(`^[a-zA-Z\[\]_^{|}][a-zA-Z0-9\[\]_^{|}]*$`)
 	channelRegexp = regexp.MustCompile(`^#[a-zA-Z0-9_\-]+$`)
+
+	usernameRegexp = regexp.MustCompile(`^[a-zA-Z0-9_\-.\[\]^{|}~]+$`)
 )
 
 func NewServer() *Server {
-	return &Server{eventChan: make(chan Event),
+	s := &Server{eventChan: make(chan Event),
 		name:        "rosella",
 		clientMap:   make(map[string]*Client),
 		channelMap:  make(map[string]*Channel),
-		operatorMap: make(map[string][]byte),
-		motd:        "Welcome to IRC. Powered by Rosella."}
+		operatorMap: make(map[string]*Operator),
+		accountMap:  make(map[string]*Account),
+		monitorMap:  make(map[string]map[*Client]struct{}),
+
+		passwordSlots: make(chan struct{}, runtime.NumCPU()),
+
+		registeredChannelMap: make(map[string]*RegisteredChannel),
+		capabilityMap: map[string]string{
+			"cap-notify":     "",
+			"message-tags":   "",
+			"account-notify": "",
+			"away-notify":    "",
+			"extended-join":  "",
+			"multi-prefix":   "",
+
+			"userhost-in-names": ""},
+		motd: "Welcome to IRC. Powered by Rosella."}
+	s.config.Store(defaultConfig())
+	s.created = time.Now()
+	return s
 }
 
 func (s *Server) Run() {
+	go func() {
+		for range time.Tick(pingCheckInterval) {
+			s.eventChan <- Event{event: pingCheck}
+		}
+	}()
+
 	for event := range s.eventChan {
 		s.handleEvent(event)
 	}
 }
 
-func (s *Server) HandleConnection(conn net.Conn) {
+func (s *Server) HandleConnection(conn net.Conn, listener *Listener) {
 	client := &Client{server: s,
 		connection: conn,
 		outputChan: make(chan string),
 		signalChan: make(chan signalCode, 3),
 		channelMap: make(map[string]*Channel),
-		connected:  true}
+		capMap:     make(map[string]bool),
+		monitorMap: make(map[string]string),
+		connected:  true,
+		listener:   listener.kind,
+		secure:     listener.secure,
+
+		maxLineLength: int32(s.config.Load().Limits.LineLength)}
 
 	go client.clientThread()
 }
@@ -52,44 +86,128 @@ func (s *Server) handleEvent(e Event) {
 	switch e.event {
 	case connected:
 		//Client connected
-		e.client.reply(rplMOTDStart)
-		motd := s.motd
-		for len(motd) > 80 {
-			e.client.reply(rplMOTD, motd[:80])
-			motd = motd[80:]
-		}
-		if len(motd) > 0 {
-			e.client.reply(rplMOTD, motd)
+		client := e.client
+		client.registrationTimer = time.AfterFunc(s.config.Load().Limits.RegistrationTimeout, func() {
+			s.eventChan <- Event{client: client, event: registrationTimeout}
+		})
+
+		if e.client.secure {
+			e.client.reply(rplNotice, s.name, "*", "*** You are connected securely")
+		} else {
+			e.client.reply(rplNotice, s.name, "*", "*** Your connection is not secure, you won't be able to join +Z channels")
 		}
-		e.client.reply(rplEndOfMOTD)
+
 	case disconnected:
-		//Client disconnected
+		//Client's connection failed or was closed
+		e.client.quit(e.input)
 	case command:
-		//Client send a command
-		fields := strings.Fields(e.input)
-		if len(fields) < 1 {
+		//Client send a command. Anything it sends shows it's still alive.
+		if !e.client.connected {
+			//Already quit, but some input was still on its way
+			return
+		}
+		e.client.lastActive = time.Now()
+		e.client.pingSent = time.Time{}
+
+		msg, err := parseMessage(e.input)
+		if err != nil {
 			return
 		}
 
-		if strings.HasPrefix(fields[0], ":") {
-			fields = fields[1:]
+		if e.client.capMap["message-tags"] == false {
+			msg.tags = nil
+		}
+
+		s.handleCommand(e.client, msg)
+	case inputTooLong:
+		//Client sent a line longer than we allow
+		e.client.reply(errInputTooLong)
+	case rehash:
+		//Received SIGHUP
+		log.Printf("Rehashing.")
+		if err := s.rehash(); err != nil {
+			log.Printf("Rehash failed: %s", err)
+		}
+	case pingCheck:
+		//Ping idle users, and disconnect those who haven't answered in time
+		s.checkPings()
+	case passwordChecked:
+		//A password finished being checked or hashed on another goroutine
+		if e.client.connected {
+			e.callback()
+		}
+	case registrationTimeout:
+		//Client didn't finish registering in time
+		if e.client.connected && !e.client.registered {
+			e.client.quit("Registration timed out")
+		}
+	case nickTimeout:
+		//Client didn't identify for their registered nick in time
+		client := e.client
+		if client.connected && client.nickTimer != nil && client.nick == e.input {
+			if owner := s.nickOwner(client.nick); owner != nil && strings.ToLower(owner.name) != strings.ToLower(client.account) {
+				client.enforceNick()
+			}
+		}
+	}
+}
+
+//How often users are checked for idleness and ping timeouts
+const pingCheckInterval = 5 * time.Second
+
+//Ping users who have been idle for the ping interval, and disconnect any who
+//haven't answered within the ping timeout
+func (s *Server) checkPings() {
+	limits := s.config.Load().Limits
+	now := time.Now()
+
+	for _, client := range s.clientMap {
+		if !client.registered || !client.connected {
+			continue
 		}
-		command := strings.ToUpper(fields[0])
-		args := fields[1:]
 
-		s.handleCommand(e.client, command, args)
+		if client.pingSent.IsZero() {
+			if now.Sub(client.lastActive) >= limits.PingInterval {
+				client.reply(rplPing, s.name)
+				client.pingSent = now
+			}
+		} else if now.Sub(client.pingSent) >= limits.PingTimeout {
+			client.quit(fmt.Sprintf("Ping timeout: %d seconds", int(limits.PingTimeout.Seconds())))
+		}
 	}
 }
 
-func (s *Server) handleCommand(client *Client, command string, args []string) {
+func (s *Server) handleCommand(client *Client, msg *Message) {
+	command := msg.command
+	args := msg.params
 
 	switch command {
 	case "PING":
-		client.reply(rplPong)
+		if len(args) < 1 {
+			client.reply(errNoOrigin)
+			return
+		}
+		client.reply(rplPong, args[0])
+	case "PONG":
+		//Nothing to do, receiving anything at all resets the ping timeout
 	case "INFO":
 		client.reply(rplInfo, "Rosella IRCD github.com/eXeC64/Rosella")
 	case "VERSION":
 		client.reply(rplVersion, VERSION)
+	case "LUSERS":
+		if client.registered == false {
+			client.reply(errNotReg)
+			return
+		}
+
+		client.sendLusers()
+	case "MOTD":
+		if client.registered == false {
+			client.reply(errNotReg)
+			return
+		}
+
+		client.sendMOTD()
 	case "NICK":
 		if len(args) < 1 {
 			client.reply(errNoNick)
@@ -99,7 +217,7 @@ func (s *Server) handleCommand(client *Client, command string, args []string) {
 		newNick := args[0]
 
 		//Check newNick is of valid formatting (regex)
-		if nickRegexp.MatchString(newNick) == false {
+		if nickRegexp.MatchString(newNick) == false || len(newNick) > s.config.Load().Limits.NickLength {
 			client.reply(errInvalidNick, newNick)
 			return
 		}
@@ -115,17 +233,75 @@ func (s *Server) handleCommand(client *Client, command string, args []string) {
 			return
 		}
 
+		//Protect the services' nicks from being used
+		if isServiceNick(newNick) {
+			client.reply(errNickInUse, newNick)
+			return
+		}
+
 		client.setNick(newNick)
+		client.tryRegister()
+
+	case "CAP":
+		s.handleCap(client, args)
+
+	case "AUTHENTICATE":
+		s.handleAuthenticate(client, args)
+
+	case "NICKSERV", "NS":
+		if client.registered == false {
+			client.reply(errNotReg)
+			return
+		}
+
+		s.handleNickServ(client, strings.Fields(strings.Join(args, " ")))
+
+	case "CHANSERV", "CS":
+		if client.registered == false {
+			client.reply(errNotReg)
+			return
+		}
+
+		s.handleChanServ(client, strings.Fields(strings.Join(args, " ")))
+
+	case "PASS":
+		if client.registered {
+			client.reply(errAlreadyReg)
+			return
+		}
+
+		if len(args) < 1 {
+			client.reply(errMoreArgs)
+			return
+		}
+
+		client.password = args[0]
 
 	case "USER":
-		if client.nick == "" {
-			client.reply(rplKill, "Your nickname is already being used", "")
-			client.disconnect()
-		} else {
-			client.reply(rplWelcome)
-			client.registered = true
+		if client.registered || client.username != "" {
+			client.reply(errAlreadyReg)
+			return
+		}
+
+		if len(args) < 4 {
+			client.reply(errMoreArgs)
+			return
+		}
+
+		if !usernameRegexp.MatchString(args[0]) {
+			client.reply(errInvalidUsername)
+			return
 		}
 
+		username := args[0]
+		if len(username) > maxUsernameLength {
+			username = username[:maxUsernameLength]
+		}
+		client.username = username
+		client.realname = args[3]
+
+		client.tryRegister()
+
 	case "JOIN":
 		if client.registered == false {
 			client.reply(errNotReg)
@@ -148,7 +324,7 @@ func (s *Server) handleCommand(client *Client, command string, args []string) {
 		channels := strings.Split(args[0], ",")
 		for _, channel := range channels {
 			//Join the channel if it's valid
-			if channelRegexp.MatchString(channel) {
+			if channelRegexp.MatchString(channel) && len(channel) <= s.config.Load().Limits.ChannelLength {
 				client.joinChannel(channel)
 			}
 		}
@@ -164,7 +340,10 @@ func (s *Server) handleCommand(client *Client, command string, args []string) {
 			return
 		}
 
-		reason := strings.Join(args[1:], " ")
+		reason := ""
+		if len(args) > 1 {
+			reason = args[1]
+		}
 
 		channels := strings.Split(args[0], ",")
 		for _, channel := range channels {
@@ -185,45 +364,42 @@ func (s *Server) handleCommand(client *Client, command string, args []string) {
 			return
 		}
 
-		message := strings.Join(args[1:], " ")
+		s.relayMessage(client, command, args[0], clientTags(msg.tags), args[1])
 
-		channel, chanExists := s.channelMap[strings.ToLower(args[0])]
-		client2, clientExists := s.clientMap[strings.ToLower(args[0])]
-
-		if chanExists {
-			if channel.mode.noExternal {
-				if _, inChannel := channel.clientMap[client.key]; !inChannel {
-					//Not in channel, not allowed to send
-					client.reply(errCannotSend, args[0])
-					return
-				}
-			}
-			if channel.mode.moderated {
-				clientMode := channel.modeMap[client.key]
-				if !clientMode.operator && !clientMode.voice {
-					//It's moderated and we're not +v or +o, do nothing
-					client.reply(errCannotSend, args[0])
-					return
-				}
-			}
-			for _, c := range channel.clientMap {
-				if c != client {
-					c.reply(rplMsg, client.nick, args[0], message)
-				}
-			}
-		} else if clientExists {
-			client2.reply(rplMsg, client.nick, client2.nick, message)
-		} else {
-			client.reply(errNoSuchNick, args[0])
+	case "NOTICE":
+		//Nothing may ever be sent back in response to a notice, not even an
+		//error, so that automatic replies can't loop between bots
+		if client.registered == false || len(args) < 2 {
+			return
 		}
 
-	case "QUIT":
+		s.relayMessage(client, command, args[0], clientTags(msg.tags), args[1])
+
+	case "TAGMSG":
 		if client.registered == false {
 			client.reply(errNotReg)
 			return
 		}
 
-		client.disconnect()
+		if len(args) < 1 {
+			client.reply(errMoreArgs)
+			return
+		}
+
+		tags := clientTags(msg.tags)
+		if len(tags) == 0 {
+			//Nothing to relay
+			return
+		}
+
+		s.relayMessage(client, command, args[0], tags, "")
+
+	case "QUIT":
+		reason := "Client Quit"
+		if len(args) > 0 && args[0] != "" {
+			reason = "Quit: " + args[0]
+		}
+		client.quit(reason)
 
 	case "TOPIC":
 		if client.registered == false {
@@ -247,27 +423,53 @@ func (s *Server) handleCommand(client *Client, command string, args []string) {
 			return
 		}
 
-		clientMode := channel.modeMap[client.key]
-		if channel.mode.topicLocked && !clientMode.operator {
+		if channel.mode.topicLocked && !channel.isOperator(client) && !client.hasPrivilege(privOverride) {
 			client.reply(errNoPriv)
 			return
 		}
 
-		if args[1] == ":" {
+		if args[1] == "" {
 			channel.topic = ""
 			for _, client := range channel.clientMap {
 				client.reply(rplNoTopic, channel.name)
 			}
 		} else {
-			topic := strings.Join(args[1:], " ")
-			topic = strings.TrimPrefix(topic, ":")
-			channel.topic = topic
+			channel.topic = args[1]
 
 			for _, client := range channel.clientMap {
 				client.reply(rplTopic, channel.name, channel.topic)
 			}
 		}
 
+		if err := s.updateRegisteredChannel(channel); err != nil {
+			client.serviceReply(chanServ, "The topic of "+channel.name+" could not be saved to its registration.")
+		}
+
+	case "NAMES":
+		if client.registered == false {
+			client.reply(errNotReg)
+			return
+		}
+
+		if len(args) < 1 {
+			//Every channel the user can see
+			for _, channel := range s.channelMap {
+				if channel.isVisibleTo(client) {
+					client.sendNames(channel)
+				}
+			}
+			client.reply(rplEndOfNames, "*")
+			return
+		}
+
+		for _, channelName := range strings.Split(args[0], ",") {
+			//Secret channels look the same as ones that don't exist
+			if channel, exists := s.channelMap[strings.ToLower(channelName)]; exists && channel.isVisibleTo(client) {
+				client.sendNames(channel)
+			}
+			client.reply(rplEndOfNames, channelName)
+		}
+
 	case "LIST":
 		if client.registered == false {
 			client.reply(errNotReg)
@@ -275,15 +477,11 @@ func (s *Server) handleCommand(client *Client, command string, args []string) {
 		}
 
 		if len(args) == 0 {
-			for channelName, channel := range s.channelMap {
-				if channel.mode.secret {
-					if _, inChannel := channel.clientMap[client.key]; !inChannel {
-						//Not in the channel, skip
-						continue
-					}
+			for _, channel := range s.channelMap {
+				if !channel.isVisibleTo(client) {
+					continue
 				}
-				listItem := fmt.Sprintf("%s %d :%s", channelName, len(channel.clientMap), channel.topic)
-				client.reply(rplList, listItem)
+				client.reply(rplList, channel.name, strconv.Itoa(len(channel.clientMap)), channel.topic)
 			}
 
 			client.reply(rplListEnd)
@@ -291,37 +489,127 @@ func (s *Server) handleCommand(client *Client, command string, args []string) {
 			channels := strings.Split(args[0], ",")
 
 			for _, channelName := range channels {
-				if channel, exists := s.channelMap[strings.ToLower(channelName)]; exists {
-					listItem := fmt.Sprintf("%s %d :%s", channelName, len(channel.clientMap), channel.topic)
-					client.reply(rplList, listItem)
+				if channel, exists := s.channelMap[strings.ToLower(channelName)]; exists && channel.isVisibleTo(client) {
+					client.reply(rplList, channel.name, strconv.Itoa(len(channel.clientMap)), channel.topic)
 				}
 			}
 
 			client.reply(rplListEnd)
 		}
+	case "AWAY":
+		if client.registered == false {
+			client.reply(errNotReg)
+			return
+		}
+
+		message := ""
+		if len(args) > 0 {
+			message = args[0]
+		}
+		client.setAway(message)
+
+	case "ISON":
+		if client.registered == false {
+			client.reply(errNotReg)
+			return
+		}
+
+		s.handleIson(client, args)
+
+	case "USERHOST":
+		if client.registered == false {
+			client.reply(errNotReg)
+			return
+		}
+
+		s.handleUserhost(client, args)
+
+	case "MONITOR":
+		if client.registered == false {
+			client.reply(errNotReg)
+			return
+		}
+
+		s.handleMonitor(client, args)
+
+	case "WHO":
+		if client.registered == false {
+			client.reply(errNotReg)
+			return
+		}
+
+		s.handleWho(client, args)
+
+	case "WHOIS":
+		if client.registered == false {
+			client.reply(errNotReg)
+			return
+		}
+
+		s.handleWhois(client, args)
+
+	case "WHOWAS":
+		if client.registered == false {
+			client.reply(errNotReg)
+			return
+		}
+
+		s.handleWhowas(client, args)
+
 	case "OPER":
 		if client.registered == false {
 			client.reply(errNotReg)
 			return
 		}
 
-		if len(args) < 2 {
+		if len(args) < 1 {
 			client.reply(errMoreArgs)
 			return
 		}
 
+		//Operators identified by certificate don't need a password
 		username := args[0]
-		password := args[1]
+		password := ""
+		if len(args) >= 2 {
+			password = args[1]
+		}
+
+		operator, exists := s.operatorMap[username]
+		if !exists {
+			//Has no password, so it counts as a failed attempt like any other
+			operator = &Operator{name: username}
+		}
 
-		if hashedPassword, exists := s.operatorMap[username]; exists {
-			//nil means the passwords matched
-			if err := bcrypt.CompareHashAndPassword(hashedPassword, []byte(password)); err == nil {
-				client.operator = true
-				client.reply(rplOper)
+		operator.authenticate(client, password, func(matched bool) {
+			if !matched {
+				client.reply(errPassword)
 				return
 			}
+			client.operClass = operator.class
+			client.operName = operator.name
+			client.reply(rplOper)
+			client.reply(rplUMode, client.nick, "+o")
+			s.noticeOpers(fmt.Sprintf("%s is now an operator (%s)", client.nick, operator.class.name))
+		})
+
+	case "REHASH":
+		if client.registered == false {
+			client.reply(errNotReg)
+			return
+		}
+
+		if !client.hasPrivilege(privRehash) {
+			client.reply(errNoPriv)
+			return
+		}
+
+		log.Printf("Rehashing at the request of an operator.")
+		client.reply(rplRehashing, s.configFile)
+		s.noticeOpers(fmt.Sprintf("%s is rehashing the server configuration", client.nick))
+		if err := s.rehash(); err != nil {
+			log.Printf("Rehash failed: %s", err)
+			client.reply(rplNotice, s.name, client.nick, "Rehash failed: "+err.Error())
 		}
-		client.reply(errPassword)
 
 	case "KILL":
 		if client.registered == false {
@@ -329,7 +617,7 @@ func (s *Server) handleCommand(client *Client, command string, args []string) {
 			return
 		}
 
-		if client.operator == false {
+		if !client.hasPrivilege(privKill) {
 			client.reply(errNoPriv)
 			return
 		}
@@ -341,16 +629,20 @@ func (s *Server) handleCommand(client *Client, command string, args []string) {
 
 		nick := args[0]
 
-		reason := strings.Join(args[1:], " ")
+		reason := ""
+		if len(args) > 1 {
+			reason = args[1]
+		}
 
-		client, exists := s.clientMap[strings.ToLower(nick)]
+		target, exists := s.clientMap[strings.ToLower(nick)]
 		if !exists {
 			client.reply(errNoSuchNick, nick)
 			return
 		}
 
-		client.reply(rplKill, client.nick, reason)
-		client.disconnect()
+		target.reply(rplKill, client.nick, reason)
+		target.quit(fmt.Sprintf("Killed (%s (%s))", client.nick, reason))
+		s.noticeOpers(fmt.Sprintf("%s killed %s (%s)", client.nick, target.nick, reason))
 
 	case "KICK":
 		if client.registered == false {
@@ -378,17 +670,19 @@ func (s *Server) handleCommand(client *Client, command string, args []string) {
 			return
 		}
 
-		clientMode := channel.modeMap[client.key]
-		if !clientMode.operator && !client.operator {
+		if !channel.isOperator(client) && !client.hasPrivilege(privOverride) {
 			client.reply(errNoPriv)
 			return
 		}
 
-		reason := strings.Join(args[2:], " ")
+		reason := ""
+		if len(args) > 2 {
+			reason = args[2]
+		}
 
 		//It worked
-		for _, client := range channel.clientMap {
-			client.reply(rplKick, client.nick, channel.name, target.nick, reason)
+		for _, c := range channel.clientMap {
+			c.reply(rplKick, client.nick, channel.name, target.nick, reason)
 		}
 
 		delete(channel.clientMap, targetKey)
@@ -410,6 +704,15 @@ func (s *Server) handleCommand(client *Client, command string, args []string) {
 
 		channel, channelExists := s.channelMap[channelKey]
 		if !channelExists {
+			if target, exists := s.clientMap[channelKey]; exists {
+				//User modes can only be viewed, as +o is only given by OPER
+				if target != client {
+					client.reply(errUsersDontMatch)
+				} else if len(args) == 1 {
+					client.reply(rplUModeIs, client.userModes())
+				}
+				return
+			}
 			client.reply(errNoSuchNick, args[0])
 			return
 		}
@@ -421,11 +724,11 @@ func (s *Server) handleCommand(client *Client, command string, args []string) {
 			return
 		}
 
-		if cm, ok := channel.modeMap[client.key]; !ok || !cm.operator {
+		if !channel.isOperator(client) {
 			//Not a channel operator.
 
-			//If they're not an irc operator either, they'll fail
-			if !client.operator {
+			//If they can't override channel modes either, they'll fail
+			if !client.hasPrivilege(privOverride) {
 				client.reply(errNoPriv)
 				return
 			}
@@ -444,55 +747,23 @@ func (s *Server) handleCommand(client *Client, command string, args []string) {
 			}
 		}
 
-		mod := strings.ToLower(args[1])
-		if strings.HasPrefix(mod, "+") {
-			for _, char := range mod {
-				switch char {
-				case 's':
-					mode.secret = true
-				case 't':
-					mode.topicLocked = true
-				case 'm':
-					mode.moderated = true
-				case 'n':
-					mode.noExternal = true
-				case 'o':
-					if hasClient {
-						newClientMode.operator = true
-					}
-				case 'v':
-					if hasClient {
-						newClientMode.voice = true
-					}
-				}
-			}
-		} else if strings.HasPrefix(mod, "-") {
-			for _, char := range mod {
-				switch char {
-				case 's':
-					mode.secret = false
-				case 't':
-					mode.topicLocked = false
-				case 'm':
-					mode.moderated = false
-				case 'n':
-					mode.noExternal = false
-				case 'o':
-					if hasClient {
-						newClientMode.operator = false
-					}
-				case 'v':
-					if hasClient {
-						newClientMode.voice = false
-					}
-				}
+		mod := args[1]
+		if strings.HasPrefix(mod, "+") || strings.HasPrefix(mod, "-") {
+			mode.apply(mod)
+			if hasClient {
+				newClientMode.apply(mod)
 			}
 		}
 
 		if hasClient {
 			*oldClientMode = *newClientMode
 		}
-		channel.mode = mode
+		if channel.mode != mode {
+			channel.mode = mode
+			if err := s.updateRegisteredChannel(channel); err != nil {
+				client.serviceReply(chanServ, "The modes of "+channel.name+" could not be saved to its registration.")
+			}
+		}
 
 		for _, client := range channel.clientMap {
 			if hasClient {
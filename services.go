@@ -0,0 +1,182 @@
+package main
+
+import (
+	"log"
+	"strings"
+)
+
+const (
+	nickServ = "NickServ"
+)
+
+//Check whether a nick belongs to one of the built-in services
+func isServiceNick(nick string) bool {
+	switch strings.ToLower(nick) {
+	case strings.ToLower(nickServ), strings.ToLower(chanServ):
+		return true
+	}
+	return false
+}
+
+//Send a notice to the user from one of the built-in services
+func (c *Client) serviceReply(service, text string) {
+	c.reply(rplNotice, service, c.target(), text)
+}
+
+//Handle a command sent to NickServ, either with /msg NickServ or /ns
+func (s *Server) handleNickServ(client *Client, args []string) {
+	if len(args) < 1 {
+		args = []string{"HELP"}
+	}
+
+	switch strings.ToUpper(args[0]) {
+	case "HELP":
+		client.serviceReply(nickServ, "NickServ lets you register an account for your nickname, so nobody else can use it.")
+		client.serviceReply(nickServ, "REGISTER <password>           - Register your current nickname")
+		client.serviceReply(nickServ, "IDENTIFY [account] <password> - Log in to your account")
+		client.serviceReply(nickServ, "GHOST <nick> [password]       - Disconnect a user using your nickname")
+		client.serviceReply(nickServ, "REGAIN <nick> [password]      - Disconnect a user using your nickname and take it")
+
+	case "REGISTER":
+		if len(args) < 2 {
+			client.serviceReply(nickServ, "Syntax: REGISTER <password>")
+			return
+		}
+
+		if s.accountFile == "" {
+			client.serviceReply(nickServ, "Account registration is disabled on this server.")
+			return
+		}
+
+		if client.account != "" {
+			client.serviceReply(nickServ, "You are already logged in to an account.")
+			return
+		}
+
+		if s.nickOwner(client.nick) != nil {
+			client.serviceReply(nickServ, client.nick+" is already registered.")
+			return
+		}
+
+		nick := client.nick
+		client.hashPassword(args[1], func(hashedPassword []byte, err error) {
+			if err == errPasswordBusy {
+				client.serviceReply(nickServ, "Please wait until your last password has been checked.")
+				return
+			} else if err != nil {
+				log.Printf("Error hashing password: %s", err)
+				client.serviceReply(nickServ, "Registration failed, please try again later.")
+				return
+			}
+
+			//Things may have changed while the password was being hashed
+			if s.accountFile == "" || client.nick != nick || client.account != "" || s.nickOwner(nick) != nil {
+				client.serviceReply(nickServ, "Registration failed, please try again.")
+				return
+			}
+
+			account := &Account{name: client.nick, password: hashedPassword}
+			s.accountMap[client.key] = account
+			if err := saveAccounts(s.accountFile, s.accountMap); err != nil {
+				log.Printf("Error saving account file: %s", err)
+				delete(s.accountMap, client.key)
+				client.serviceReply(nickServ, "Registration failed, please try again later.")
+				return
+			}
+
+			client.serviceReply(nickServ, "Your nickname is now registered to your account, "+account.name+".")
+			client.setAccount(account.name)
+		})
+
+	case "IDENTIFY":
+		if len(args) < 2 {
+			client.serviceReply(nickServ, "Syntax: IDENTIFY [account] <password>")
+			return
+		}
+
+		if client.account != "" {
+			client.serviceReply(nickServ, "You are already logged in to an account.")
+			return
+		}
+
+		accountName, password := client.nick, args[1]
+		if len(args) > 2 {
+			accountName, password = args[1], args[2]
+		}
+
+		var hash []byte
+		account := s.nickOwner(accountName)
+		if account != nil {
+			hash = account.password
+		}
+
+		client.checkPassword(hash, password, func(matched bool) {
+			if !matched {
+				client.serviceReply(nickServ, "Invalid account or password.")
+				return
+			}
+
+			client.serviceReply(nickServ, "You are now identified for "+account.name+".")
+			client.setAccount(account.name)
+		})
+
+	case "GHOST", "REGAIN":
+		command := strings.ToUpper(args[0])
+		if len(args) < 2 {
+			client.serviceReply(nickServ, "Syntax: "+command+" <nick> [password]")
+			return
+		}
+
+		nick := args[1]
+		account := s.nickOwner(nick)
+		if account == nil {
+			client.serviceReply(nickServ, nick+" is not registered.")
+			return
+		}
+
+		if strings.ToLower(client.account) == strings.ToLower(account.name) {
+			s.ghost(client, command, nick, account, true)
+			return
+		}
+
+		if len(args) < 3 {
+			client.serviceReply(nickServ, "Access denied.")
+			return
+		}
+
+		client.checkPassword(account.password, args[2], func(matched bool) {
+			if !matched {
+				client.serviceReply(nickServ, "Access denied.")
+				return
+			}
+			s.ghost(client, command, nick, account, false)
+		})
+
+	default:
+		client.serviceReply(nickServ, "Unknown command "+strings.ToUpper(args[0])+". Try HELP.")
+	}
+}
+
+//Disconnect whoever is using a nick for GHOST or REGAIN, once the user has
+//proven they own it. REGAIN then logs them in and gives them the nick.
+func (s *Server) ghost(client *Client, command, nick string, account *Account, loggedIn bool) {
+	if target, exists := s.clientMap[strings.ToLower(nick)]; exists {
+		if target == client {
+			client.serviceReply(nickServ, "You can't ghost yourself.")
+			return
+		}
+		target.reply(rplKill, nickServ, command+" command used by "+client.nick)
+		target.quit(command + " command used by " + client.nick)
+		client.serviceReply(nickServ, target.nick+" has been disconnected.")
+	} else if command == "GHOST" {
+		client.serviceReply(nickServ, nick+" is not online.")
+		return
+	}
+
+	if command == "REGAIN" {
+		if !loggedIn {
+			client.setAccount(account.name)
+		}
+		client.setNick(account.name)
+	}
+}
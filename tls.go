@@ -0,0 +1,108 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+var tlsVersionNames = map[string]uint16{
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+var curveNames = map[string]tls.CurveID{
+	"X25519": tls.X25519,
+	"P-256":  tls.CurveP256,
+	"P-384":  tls.CurveP384,
+	"P-521":  tls.CurveP521,
+}
+
+//Look up a TLS 1.2 cipher suite by its name. TLS 1.3 suites can't be
+//configured, so they aren't found.
+func cipherSuiteID(name string) (uint16, bool) {
+	suites := append(tls.CipherSuites(), tls.InsecureCipherSuites()...)
+	for _, suite := range suites {
+		if suite.Name == name && !isTLS13Only(suite) {
+			return suite.ID, true
+		}
+	}
+	return 0, false
+}
+
+func isTLS13Only(suite *tls.CipherSuite) bool {
+	for _, version := range suite.SupportedVersions {
+		if version != tls.VersionTLS13 {
+			return false
+		}
+	}
+	return true
+}
+
+//Load every certificate named in the config. The first is served to clients
+//that don't match any other by SNI.
+func loadCertificates(config *TLSConfig) ([]tls.Certificate, error) {
+	var certificates []tls.Certificate
+
+	pairs := append([]CertificateConfig{{Cert: config.Cert, Key: config.Key}}, config.Certificates...)
+	for _, pair := range pairs {
+		certificate, err := tls.LoadX509KeyPair(pair.Cert, pair.Key)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", pair.Cert, err)
+		}
+		certificates = append(certificates, certificate)
+	}
+
+	return certificates, nil
+}
+
+//Build the TLS configuration served to clients from the config's policy and
+//either the loaded certificates or ACME. crypto/tls picks a loaded certificate
+//by SNI and by which key types the client supports.
+func (c *TLSConfig) build(certificates []tls.Certificate, acmeManager *autocert.Manager) *tls.Config {
+	tlsConfig := new(tls.Config)
+
+	tlsConfig.MinVersion = tlsVersionNames[c.MinVersion]
+	for _, name := range c.CipherSuites {
+		id, _ := cipherSuiteID(name)
+		tlsConfig.CipherSuites = append(tlsConfig.CipherSuites, id)
+	}
+	for _, name := range c.Curves {
+		tlsConfig.CurvePreferences = append(tlsConfig.CurvePreferences, curveNames[name])
+	}
+
+	if acmeManager != nil {
+		tlsConfig.GetCertificate = acmeGetCertificate(acmeManager, c.ACME.Domains[0])
+	} else {
+		tlsConfig.Certificates = certificates
+	}
+
+	return tlsConfig
+}
+
+//The TLS configuration a listener is opened with. Every handshake uses the
+//server's current TLS configuration, so a rehash can replace the certificates
+//and policy without restarting the listeners.
+func (s *Server) listenerTLSConfig(clientCerts bool) *tls.Config {
+	return &tls.Config{
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			tlsConfig := s.tlsConfig.Load()
+
+			if clientCerts {
+				//Client certificates aren't verified, only fingerprinted
+				tlsConfig = tlsConfig.Clone()
+				tlsConfig.ClientAuth = tls.RequestClientCert
+			}
+
+			//TLS-ALPN-01 challenges have to negotiate the acme-tls/1 protocol.
+			//It's only offered to the CA, as handshakes with clients asking
+			//for protocols we don't offer would fail.
+			if tlsConfig.GetCertificate != nil && isACMEChallenge(hello) {
+				tlsConfig = tlsConfig.Clone()
+				tlsConfig.NextProtos = []string{acme.ALPNProto}
+			}
+
+			return tlsConfig, nil
+		}}
+}
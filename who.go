@@ -0,0 +1,210 @@
+package main
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//Shown in place of every user's hostname. Rosella never reveals where its
+//users connect from.
+const hiddenHost = "hidden"
+
+//Shown in place of every user's IP address in WHOX replies
+const hiddenIP = "255.255.255.255"
+
+//The WHOX fields, in the order they're always sent in
+const whoxFields = "tcuihsnfdlaor"
+
+//WHOX query tokens are from one to three digits
+var whoxTokenRegexp = regexp.MustCompile(`^[0-9]{1,3}$`)
+
+//Handle WHO, listing either the members of a channel or the users whose nicks
+//match a mask. A second argument such as "%cnf,42" asks for WHOX replies with
+//only the given fields, tagged with the token after the comma.
+func (s *Server) handleWho(client *Client, args []string) {
+	if len(args) < 1 {
+		client.reply(errMoreArgs)
+		return
+	}
+
+	mask := args[0]
+
+	fields, token := "", ""
+	if len(args) > 1 && strings.HasPrefix(args[1], "%") {
+		fields = args[1][1:]
+		if comma := strings.IndexByte(fields, ','); comma > -1 {
+			fields, token = fields[:comma], fields[comma+1:]
+		}
+		//Without a valid token there's nothing to send for t, and an empty
+		//parameter would shift the fields after it
+		if !whoxTokenRegexp.MatchString(token) {
+			fields = strings.Replace(fields, "t", "", -1)
+		}
+	}
+
+	if channel, exists := s.channelMap[strings.ToLower(mask)]; exists {
+		//Nobody outside a secret channel may find out who's in it
+		if channel.isVisibleTo(client) {
+			for _, member := range channel.clientMap {
+				client.sendWho(member, channel.name, member.whoFlags(client, channel), fields, token)
+			}
+		}
+	} else if maskRegexp, err := compileMask(mask); err == nil {
+		//Channels aren't named, as the user may not be able to see them
+		for _, target := range s.clientMap {
+			if target.registered && maskRegexp.MatchString(target.key) {
+				client.sendWho(target, "*", target.whoFlags(client, nil), fields, token)
+			}
+		}
+	}
+
+	client.reply(rplEndOfWho, mask)
+}
+
+//Send the user a WHO reply about the target, or a WHOX reply if they asked for
+//fields
+func (c *Client) sendWho(target *Client, channelName, flags, fields, token string) {
+	if fields == "" {
+		c.reply(rplWhoReply, channelName, target.username, hiddenHost, target.nick, flags, target.realname)
+		return
+	}
+
+	var params []string
+	for _, field := range whoxFields {
+		if !strings.ContainsRune(fields, field) {
+			continue
+		}
+
+		switch field {
+		case 't':
+			params = append(params, token)
+		case 'c':
+			params = append(params, channelName)
+		case 'u':
+			params = append(params, target.username)
+		case 'i':
+			params = append(params, hiddenIP)
+		case 'h':
+			params = append(params, hiddenHost)
+		case 's':
+			params = append(params, c.server.name)
+		case 'n':
+			params = append(params, target.nick)
+		case 'f':
+			params = append(params, flags)
+		case 'd':
+			params = append(params, "0")
+		case 'l':
+			params = append(params, strconv.Itoa(target.idleSeconds()))
+		case 'a':
+			if target.account == "" {
+				params = append(params, "0")
+			} else {
+				params = append(params, target.account)
+			}
+		case 'o':
+			params = append(params, "n/a")
+		case 'r':
+			params = append(params, target.realname)
+		}
+	}
+	c.reply(rplWhoxReply, params...)
+}
+
+//The user's flags in a WHO reply to the requester: H for here or G for gone,
+//* for operators, and their status prefix if a channel is given
+func (c *Client) whoFlags(requester *Client, channel *Channel) string {
+	flags := "H"
+	if c.away != "" {
+		flags = "G"
+	}
+	if c.operClass != nil {
+		flags += "*"
+	}
+	if channel != nil {
+		flags += requester.statusPrefix(channel.modeMap[c.key])
+	}
+	return flags
+}
+
+//Handle WHOIS for one or more comma separated nicks. Only what the design
+//principles permit is given out, and channels are only listed if the user may
+//see them.
+func (s *Server) handleWhois(client *Client, args []string) {
+	if len(args) < 1 {
+		client.reply(errNoNick)
+		return
+	}
+
+	//The first argument may name a server, which is always us
+	nicks := args[0]
+	if len(args) > 1 {
+		nicks = args[1]
+	}
+
+	for _, nick := range strings.Split(nicks, ",") {
+		if nick == "" {
+			continue
+		}
+
+		target, exists := s.clientMap[strings.ToLower(nick)]
+		if !exists || !target.registered {
+			client.reply(errNoSuchNick, nick)
+			client.reply(rplEndOfWhois, nick)
+			continue
+		}
+
+		client.reply(rplWhoisUser, target.nick, target.username, hiddenHost, target.realname)
+
+		channels := make([]string, 0, len(target.channelMap))
+		for _, channel := range target.channelMap {
+			if !channel.isVisibleTo(client) {
+				continue
+			}
+			channels = append(channels, client.statusPrefix(channel.modeMap[target.key])+channel.name)
+		}
+		if len(channels) > 0 {
+			client.reply(rplWhoisChannels, target.nick, strings.Join(channels, " "))
+		}
+
+		client.reply(rplWhoisServer, target.nick)
+		if target.away != "" {
+			client.reply(rplAway, target.nick, target.away)
+		}
+		if target.operClass != nil {
+			client.reply(rplWhoisOperator, target.nick)
+		}
+		if target.account != "" {
+			client.reply(rplWhoisAccount, target.nick, target.account)
+		}
+		if target.secure {
+			client.reply(rplWhoisSecure, target.nick)
+		}
+		//Fingerprints identify users and the listener may give away how they
+		//connect, so only their owner and operators get to see them
+		if target == client || client.operClass != nil {
+			if target.certfp != "" {
+				client.reply(rplWhoisCertfp, target.nick, target.certfp)
+			}
+			client.reply(rplWhoisListener, target.nick, target.listener.String())
+		}
+		client.reply(rplWhoisIdle, target.nick, strconv.Itoa(target.idleSeconds()), strconv.FormatInt(target.signon.Unix(), 10))
+		client.reply(rplEndOfWhois, target.nick)
+	}
+}
+
+//How long since the user last sent a message
+func (c *Client) idleSeconds() int {
+	return int(time.Since(c.lastMessage).Seconds())
+}
+
+//Compile a mask such as "foo*" into a regexp matching lowercased nicks, where
+//* matches any number of characters and ? matches exactly one
+func compileMask(mask string) (*regexp.Regexp, error) {
+	pattern := regexp.QuoteMeta(strings.ToLower(mask))
+	pattern = strings.Replace(pattern, `\*`, ".*", -1)
+	pattern = strings.Replace(pattern, `\?`, ".", -1)
+	return regexp.Compile("^" + pattern + "$")
+}
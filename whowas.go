@@ -0,0 +1,97 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"time"
+)
+
+//A nick that was given up, either by changing nick or disconnecting. Only the
+//fields WHOIS would show are kept, and never anywhere but in memory.
+type WhowasEntry struct {
+	nick     string
+	username string
+	realname string
+	account  string
+	left     time.Time //When the nick was given up
+}
+
+//Remember the user's current nick for WHOWAS. The history only holds the
+//configured number of entries, dropping the oldest first.
+func (s *Server) recordWhowas(c *Client) {
+	s.whowas = append(s.whowas, WhowasEntry{nick: c.nick,
+		username: c.username,
+		realname: c.realname,
+		account:  c.account,
+		left:     time.Now()})
+	s.trimWhowas()
+}
+
+//Drop the oldest WHOWAS entries until the history fits the configured size
+func (s *Server) trimWhowas() {
+	size := s.config.Load().Limits.WhowasSize
+	if excess := len(s.whowas) - size; excess > 0 {
+		copy(s.whowas, s.whowas[excess:])
+		//Don't keep anything about the dropped users alive
+		for i := size; i < len(s.whowas); i++ {
+			s.whowas[i] = WhowasEntry{}
+		}
+		s.whowas = s.whowas[:size]
+	}
+}
+
+//Look up who last used a nick, newest first, leaving out expired entries.
+//A count of 0 or less means every entry.
+func (s *Server) lookupWhowas(nick string, count int) []WhowasEntry {
+	expiry := s.config.Load().Limits.WhowasExpiry
+
+	var entries []WhowasEntry
+	for i := len(s.whowas) - 1; i >= 0; i-- {
+		entry := s.whowas[i]
+		if time.Since(entry.left) > expiry {
+			//Everything older has expired as well
+			break
+		}
+		if strings.ToLower(entry.nick) != strings.ToLower(nick) {
+			continue
+		}
+		entries = append(entries, entry)
+		if count > 0 && len(entries) >= count {
+			break
+		}
+	}
+	return entries
+}
+
+//Handle WHOWAS for one or more comma separated nicks, optionally limited to
+//the given number of entries per nick
+func (s *Server) handleWhowas(client *Client, args []string) {
+	if len(args) < 1 {
+		client.reply(errNoNick)
+		return
+	}
+
+	count := 0
+	if len(args) > 1 {
+		count, _ = strconv.Atoi(args[1])
+	}
+
+	for _, nick := range strings.Split(args[0], ",") {
+		if nick == "" {
+			continue
+		}
+
+		entries := s.lookupWhowas(nick, count)
+		if len(entries) == 0 {
+			client.reply(errWasNoSuchNick, nick)
+		}
+		for _, entry := range entries {
+			client.reply(rplWhowasUser, entry.nick, entry.username, hiddenHost, entry.realname)
+			if entry.account != "" {
+				client.reply(rplWhoisAccount, entry.nick, entry.account)
+			}
+			client.reply(rplWhowasServer, entry.nick, entry.left.Format(time.RFC1123))
+		}
+		client.reply(rplEndOfWhowas, nick)
+	}
+}